@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/fakeuser"
+)
+
+// Serve a stand-in of the user service from a token table, for local development
+func fakeUsers(args []string) error {
+	flags := flag.NewFlagSet("fake-users", flag.ContinueOnError)
+	addr := flags.String("addr", "127.0.0.1:8081", "address to listen on")
+	tokens := flags.String("tokens", "configs/fake_users.yml", "YAML file with the token table")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: book-service fake-users [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	server, err := fakeuser.Load(*tokens)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Fake user service is listening", "addr", *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
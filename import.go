@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/app"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+// Import books from a CSV, NDJSON or MARC 21 file straight into the configured store
+func importBooks(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := flags.String("format", "", "input format: csv, ndjson or marc (default: guessed from file extension)")
+	mode := flags.String("mode", string(library.ImportCreate), "create, upsert-id or upsert-isbn")
+	dryRun := flags.Bool("dry-run", false, "validate rows without writing them")
+	columns := flags.String("columns", "", "comma separated header=field pairs, e.g. Name=title,Writer=author")
+	loader := app.NewConfigLoader(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: book-service import [flags] FILE")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("import expects exactly one file")
+	}
+	path := flags.Arg(0)
+
+	var opts library.ImportOptions
+	var err error
+	if *format == "" {
+		*format = strings.TrimPrefix(filepath.Ext(path), ".")
+	}
+	if opts.Format, err = library.ParseImportFormat(*format); err != nil {
+		return err
+	}
+	if opts.Mode, err = library.ParseImportMode(*mode); err != nil {
+		return err
+	}
+	opts.DryRun = *dryRun
+	if opts.Columns, err = parseColumns(*columns); err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	appInstance, err := openApp(loader)
+	if err != nil {
+		return err
+	}
+	defer appInstance.Close()
+	service := appInstance.Service()
+
+	// The command line is trusted to see and update books of any visibility
+	ctx := library.WithSystemAccess(context.Background())
+	report, err := library.NewImporter(service).Import(ctx, file, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to import books: %v", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("%d of %d rows failed", report.Failed, report.Total)
+	}
+	return nil
+}
+
+// Build the book service the same way the HTTP server does, the app must be closed after use
+func openApp(loader *app.ConfigLoader) (*app.App, error) {
+	config, err := loader.Load()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config: %s", err)
+	}
+
+	ctx := context.Background()
+	appInstance, err := app.New(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to initialize app: %v", err)
+	}
+	if err := appInstance.Setup(ctx); err != nil {
+		appInstance.Close()
+		return nil, fmt.Errorf("Failed to setup app: %v", err)
+	}
+
+	return appInstance, nil
+}
+
+func parseColumns(value string) (map[string]string, error) {
+	columns := make(map[string]string)
+	if value == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		header, field, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid column mapping %q, expected header=field", pair)
+		}
+		columns[strings.TrimSpace(header)] = strings.TrimSpace(field)
+	}
+	return columns, nil
+}
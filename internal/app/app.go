@@ -2,96 +2,399 @@ package app
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
 	"os"
-	"os/signal"
+	"runtime/debug"
 	"time"
 
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/health"
 	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
-	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/sqlite"
-	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/lifecycle"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/metrics"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oai"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/storage"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/tracing"
 	"github.com/pkg/errors"
 
 	"github.com/go-chi/chi/v5"
-	"golang.org/x/sync/errgroup"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
+// Version of the service, set at build time with -ldflags "-X .../internal/app.Version=..."
+var Version string
+
 type App struct {
-	config *Config
-	router *chi.Mux
-	http   *http.Server
+	config  *Config
+	router  *chi.Mux
+	http    *http.Server
+	service library.BookService
+	users   *library.CachedUserService
+	metrics *metrics.Metrics
+	logger  *slog.Logger
+	health  *health.Checker
+
+	// Parts of the configuration swapped by Reload
+	logLevel   *slog.LevelVar
+	ipLimit    *library.RateLimiter
+	readLimit  *library.RateLimiter
+	writeLimit *library.RateLimiter
+	userClient *userClientSwitch
+	reload     *reloader
+
+	// Stops the components in reverse order of construction
+	lifecycle *lifecycle.Manager
 }
 
 func New(ctx context.Context, config *Config) (*App, error) {
+	logLevel := new(slog.LevelVar)
+	logger, err := NewLogger(config.Log, logLevel, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	components := lifecycle.New(logger)
+
+	stopTracing, err := tracing.Setup(tracing.Options{
+		ServiceName: "book-service",
+		Exporter:    config.Tracing.Exporter,
+		File:        config.Tracing.File,
+		SampleRatio: config.Tracing.SampleRatio,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Spans not exported yet are flushed last, after everything that could record them
+	components.OnStop("tracing", stopTracing)
+
+	serverTLS, err := tlsConfig(config.Server.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	m := metrics.New()
+
 	r := chi.NewRouter()
+	// Every request gets an ID, it's recorded in the audit log, the access log and echoed to the client
+	r.Use(middleware.RequestID, requestIDHeader, tracing.Middleware, library.AccessLog(logger), m.Middleware)
 	return &App{
-		config: config,
-		router: r,
+		config:    config,
+		router:    r,
+		metrics:   m,
+		logger:    logger,
+		logLevel:  logLevel,
+		lifecycle: components,
 		http: &http.Server{
 			Addr:              config.Host + ":" + config.Port,
 			Handler:           r,
-			ReadTimeout:       0,
-			ReadHeaderTimeout: 0,
-			WriteTimeout:      0,
-			IdleTimeout:       0,
-			MaxHeaderBytes:    0,
+			ReadTimeout:       config.Server.ReadTimeout,
+			ReadHeaderTimeout: config.Server.ReadHeaderTimeout,
+			WriteTimeout:      config.Server.WriteTimeout,
+			IdleTimeout:       config.Server.IdleTimeout,
+			MaxHeaderBytes:    config.Server.MaxHeaderBytes,
+			TLSConfig:         serverTLS,
+			ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
 		},
 	}, nil
 }
 
+// NewLogger creates a logger writing records of the configured format to w.
+// The configured level is set on the level variable, which can be changed later.
+func NewLogger(cfg Log, level *slog.LevelVar, w io.Writer) (*slog.Logger, error) {
+	if err := setLogLevel(level, cfg.Level); err != nil {
+		return nil, err
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.Format {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text or json", cfg.Format)
+	}
+}
+
+func setLogLevel(level *slog.LevelVar, name string) error {
+	if name == "" {
+		level.Set(slog.LevelInfo)
+		return nil
+	}
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("invalid log level %q", name)
+	}
+	return nil
+}
+
+// Echo the request ID so that clients can refer to it
+func requestIDHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	})
+}
+
 // Initialize db, service and setup Handler with HTTP requests
 func (a *App) Setup(ctx context.Context) error {
-	// Initialize db
-	store, err := sqlite.NewSQLiteBookStore(a.config.DB.DSN)
+	// Initialize the storage backend selected by database.driver
+	store, err := storage.Open(a.config.DB.Driver, storage.Options{
+		DSN: a.config.DB.DSN,
+		SQLite: storage.SQLiteOptions{
+			WAL:          a.config.DB.SQLite.WAL,
+			BusyTimeout:  a.config.DB.SQLite.BusyTimeout,
+			MaxOpenConns: a.config.DB.SQLite.MaxOpenConns,
+		},
+		Memory: storage.MemoryOptions{
+			SnapshotFile: a.config.DB.Memory.SnapshotFile,
+			WAL:          a.config.DB.Memory.WAL,
+		},
+	})
 	if err != nil {
-		return errors.Wrap(err, oops.ErrDBSetup.Error())
+		return err
 	}
+	a.lifecycle.OnStop("database", func(context.Context) error { return store.Close() })
+	if checkpointer, ok := store.(storage.Checkpointer); ok && a.config.DB.Memory.SnapshotInterval > 0 {
+		a.lifecycle.Go("snapshots", func(ctx context.Context) error {
+			return snapshots(ctx, checkpointer, a.config.DB.Memory.SnapshotInterval)
+		})
+	}
+
+	a.health = health.New(version(), a.config.Health.Timeout,
+		health.WithCacheTTL(a.config.Health.CacheTTL), health.WithLogger(a.logger))
+	a.health.Add("database", store.Check)
+	a.health.Register(a.router)
 
-	// Initialize service
-	service := library.NewBookService(store)
+	// Connection pool statistics of backends having one
+	if db, ok := store.(interface{ DB() *sql.DB }); ok {
+		a.metrics.RegisterDB("books", db.DB())
+	}
+	a.metrics.RegisterCatalogue(store)
+
+	// Initialize service, changes are recorded in the audit log next to the books
+	books := tracing.Store(a.metrics.Store(store))
+	audit := tracing.Audit(a.metrics.Audit(store))
+	service := tracing.Service(library.NewBookService(books, library.WithAudit(audit)))
+	a.service = service
 
 	// Create User
-	user := library.NewUserServiceClient(a.config.UserHost + ":" + a.config.UserInternalPort)
+	user, err := a.userService()
+	if err != nil {
+		return err
+	}
 
-	// Create Handler
-	handler := library.NewHandler(a.router, service, user)
+	// Create Handler, limits are kept even when disabled, so that a reload can enable them
+	a.ipLimit = rateLimiter(a.config.RateLimit.IP, library.WithRateLimitByIP())
+	a.readLimit = rateLimiter(a.config.RateLimit.Read)
+	a.writeLimit = rateLimiter(a.config.RateLimit.Write)
+	handler := library.NewHandler(a.router, service, user, library.WithRateLimits(a.readLimit, a.writeLimit),
+		library.WithIPRateLimit(a.ipLimit), library.WithMaxBodyBytes(int64(a.config.Server.MaxBodyBytes)),
+		library.WithMaxImportBytes(int64(a.config.Server.MaxImportBytes)))
 	handler.Register()
 
+	// Create OAI-PMH provider for union catalogue harvesters
+	harvest := oai.NewHandler(a.router, service, oai.Repository{
+		Name:       a.config.OAI.RepositoryName,
+		BaseURL:    a.config.OAI.BaseURL,
+		AdminEmail: a.config.OAI.AdminEmail,
+		Identifier: a.config.OAI.Identifier,
+		PageSize:   a.config.OAI.PageSize,
+	}, oai.WithRateLimit(a.readLimit))
+	harvest.Register()
+
+	a.router.Method(http.MethodGet, "/metrics", a.metrics.Handler())
+
 	return nil
 }
 
-// Run HTTP-server
-func (a *App) Start() error {
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
+// Write the books kept in memory out periodically, the last snapshot is written when the store is closed
+func snapshots(ctx context.Context, store storage.Checkpointer, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			start := time.Now()
+			if err := store.Checkpoint(); err != nil {
+				slog.Error("snapshot failed", "error", err)
+				continue
+			}
+			slog.Debug("wrote snapshot", "latency", time.Since(start))
+		}
+	}
+}
 
-	errs, ctx := errgroup.WithContext(ctx)
+// Version set at build time, or the VCS revision the binary was built from
+func version() string {
+	if Version != "" {
+		return Version
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+}
 
-	log.Printf("starting web server on port %s", a.config.Port)
+// Limiter of clients, letting every request through while the rate is zero
+func rateLimiter(cfg RateLimit, opts ...library.RateLimiterOption) *library.RateLimiter {
+	return library.NewRateLimiter(library.RateLimit{Rate: cfg.Rate, Burst: cfg.Burst}, opts...)
+}
 
-	// Run server
-	errs.Go(func() error {
-		if err := a.http.ListenAndServe(); err != nil {
-			return fmt.Errorf("listen and serve error: %w", err)
+// Resolver of tokens selected by auth.mode
+func (a *App) userService() (library.UserService, error) {
+	switch a.config.Auth.Mode {
+	case "", "remote":
+		// Permission masks are cached between requests
+		var cacheOpts []library.CacheOption
+		if a.config.UserCache.TTL > 0 {
+			cacheOpts = append(cacheOpts, library.WithCacheTTL(a.config.UserCache.TTL))
 		}
-		return nil
-	})
+		if a.config.UserCache.NegativeTTL > 0 {
+			cacheOpts = append(cacheOpts, library.WithCacheNegativeTTL(a.config.UserCache.NegativeTTL))
+		}
+		if a.config.UserCache.Size > 0 {
+			cacheOpts = append(cacheOpts, library.WithCacheSize(a.config.UserCache.Size))
+		}
+		// The client is replaced when a reload changes the address or resilience settings
+		a.userClient = newUserClientSwitch(newUserClient(a.config))
+		a.health.Add("user_service", a.userClient.Ping)
+		a.lifecycle.OnStop("user_service", func(context.Context) error {
+			a.userClient.CloseIdleConnections()
+			return nil
+		})
 
-	<-ctx.Done()
+		// Only calls that miss the cache are measured
+		a.users = library.NewCachedUserService(a.metrics.Users(tracing.Users(a.userClient)), cacheOpts...)
+		a.metrics.RegisterUserCache(a.users)
+		return a.users, nil
+	case "jwt":
+		return a.jwtUserService()
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", a.config.Auth.Mode)
+	}
+}
 
-	// Graceful shutdown (we got the interrupt signal)
-	stop()
-	log.Println("shutting down gracefully")
+// Local verifier of signed tokens
+func (a *App) jwtUserService() (*library.JWTUserService, error) {
+	cfg := a.config.Auth.JWT
 
-	// Perform application shutdown with a maximum timeout of 5 seconds
-	timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	var keys []library.JWTKey
+	if cfg.HMACSecret != "" {
+		keys = append(keys, library.HMACKey(cfg.HMACSecret))
+	}
+	if cfg.PublicKeyFile != "" {
+		key, err := library.LoadPEMKey(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if cfg.JWKSFile != "" {
+		set, err := library.LoadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, set...)
+	}
 
-	if err := a.http.Shutdown(timeoutCtx); err != nil {
-		log.Println("error during shutdown:", err)
+	opts := []library.JWTOption{
+		library.WithJWTAudience(cfg.Audience),
+		library.WithJWTIssuer(cfg.Issuer),
+		library.WithJWTLeeway(cfg.Leeway),
 	}
+	if cfg.PermissionsClaim != "" {
+		opts = append(opts, library.WithJWTPermissionsClaim(cfg.PermissionsClaim))
+	}
+	return library.NewJWTUserService(keys, opts...)
+}
 
-	return nil
+// Client of the user service, unset settings keep the library defaults
+func newUserClient(config *Config) *library.UserServiceClient {
+	cfg := config.UserClient
+	orDefault := func(value, def time.Duration) time.Duration {
+		if value > 0 {
+			return value
+		}
+		return def
+	}
+
+	// Zero retries and a zero threshold are taken as they are, they turn retries and the breaker off
+	return library.NewUserServiceClient(
+		config.UserHost+":"+config.UserInternalPort,
+		library.WithUserTimeout(orDefault(cfg.Timeout, library.DefaultUserTimeout)),
+		library.WithUserRetries(cfg.Retries,
+			orDefault(cfg.Backoff, library.DefaultUserBackoff),
+			orDefault(cfg.MaxBackoff, library.DefaultUserMaxBackoff)),
+		library.WithUserBreaker(cfg.BreakerThreshold,
+			orDefault(cfg.BreakerCooldown, library.DefaultBreakerCooldown), library.SystemClock),
+	)
+}
+
+// Permission cache built by Setup, used to drop tokens whose permissions changed.
+// Nil unless tokens are resolved by the user service.
+func (a *App) Users() *library.CachedUserService {
+	return a.users
+}
+
+// Book service built by Setup, for commands working without HTTP
+func (a *App) Service() library.BookService {
+	return a.service
+}
+
+// Run HTTP-server until SIGINT or SIGTERM, then drain requests and background jobs
+// and close everything Setup opened. Errors of startup and shutdown are returned.
+func (a *App) Start() error {
+	ln, err := listen(a.config.Server, a.http.Addr)
+	if err != nil {
+		if closeErr := a.Close(); closeErr != nil {
+			a.logger.Error("failed to close", "error", closeErr)
+		}
+		return err
+	}
+	a.logger.Info("starting web server", "addr", ln.Addr().String(), "tls", a.http.TLSConfig != nil)
+
+	a.lifecycle.Serve("http",
+		func() error {
+			var err error
+			if a.http.TLSConfig != nil {
+				// The certificate comes from the TLS config, which reloads it
+				err = a.http.ServeTLS(ln, "", "")
+			} else {
+				err = a.http.Serve(ln)
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				return nil
+			}
+			return err
+		},
+		func(ctx context.Context) error {
+			// Stop receiving new traffic before the listeners go away
+			a.health.Shutdown()
+			select {
+			case <-time.After(a.config.Health.DrainDelay):
+			case <-ctx.Done():
+			}
+			return a.http.Shutdown(ctx)
+		})
+	if a.reload != nil {
+		a.lifecycle.Go("config_watcher", a.watchConfig)
+	}
+
+	return a.lifecycle.Run(context.Background(), a.config.Server.ShutdownTimeout)
+}
+
+// Close releases everything Setup opened, for commands working without the server
+func (a *App) Close() error {
+	return a.lifecycle.Stop(a.config.Server.ShutdownTimeout)
 }
@@ -1,35 +1,298 @@
 package app
 
 import (
-	"os"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-	"gopkg.in/yaml.v3"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/health"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/storage"
 )
 
 type Config struct {
-	Host             string   `yaml:"host" json:"host" env:"SERVER_HOST"`
-	Port             string   `yaml:"port" json:"port" env:"SERVER_PORT"`
-	UserHost         string   `yaml:"user_host" json:"user_host" env:"USER_HOST"`
-	UserInternalPort string   `yaml:"user_internal_port" json:"user_internal_port" env:"USER_INTERNAL_PORT"`
-	DB               Database `yaml:"database" json:"database"`
+	Host             string     `yaml:"host" json:"host" env:"SERVER_HOST"`
+	Port             string     `yaml:"port" json:"port" env:"SERVER_PORT"`
+	Server           Server     `yaml:"server" json:"server"`
+	UserHost         string     `yaml:"user_host" json:"user_host" env:"USER_HOST"`
+	UserInternalPort string     `yaml:"user_internal_port" json:"user_internal_port" env:"USER_INTERNAL_PORT"`
+	Auth             Auth       `yaml:"auth" json:"auth"`
+	UserClient       UserClient `yaml:"user_client" json:"user_client"`
+	UserCache        UserCache  `yaml:"user_cache" json:"user_cache"`
+	RateLimit        RateLimits `yaml:"rate_limit" json:"rate_limit"`
+	Log              Log        `yaml:"log" json:"log"`
+	Tracing          Tracing    `yaml:"tracing" json:"tracing"`
+	Health           Health     `yaml:"health" json:"health"`
+	Reload           Reload     `yaml:"reload" json:"reload"`
+	DB               Database   `yaml:"database" json:"database"`
+	OAI              OAI        `yaml:"oai" json:"oai"`
 }
 
+// HTTP server: timeouts bound slow clients and zero disables one. With socket set the service
+// listens on that Unix socket instead of host and port. Shutdown, draining requests and
+// background jobs and closing the store, takes at most shutdown_timeout.
+type Server struct {
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" json:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" json:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes" json:"max_header_bytes"`
+	MaxBodyBytes      int           `yaml:"max_body_bytes" json:"max_body_bytes"`
+	MaxImportBytes    int           `yaml:"max_import_bytes" json:"max_import_bytes"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	Socket            string        `yaml:"socket" json:"socket" env:"SERVER_SOCKET"`
+	TLS               TLS           `yaml:"tls" json:"tls"`
+}
+
+// TLS is served when a certificate and key are set, both are read again whenever they change on disk.
+// Callers present certificates signed by client_ca_file with client_auth require, or may do so with verify_if_given.
+type TLS struct {
+	CertFile     string `yaml:"cert_file" json:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile      string `yaml:"key_file" json:"key_file" env:"TLS_KEY_FILE"`
+	ClientCAFile string `yaml:"client_ca_file" json:"client_ca_file"`
+	ClientAuth   string `yaml:"client_auth" json:"client_auth"`
+}
+
+// Logging: level is one of debug, info, warn, error and format is text or json
+type Log struct {
+	Level  string `yaml:"level" json:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" json:"format" env:"LOG_FORMAT"`
+}
+
+// Tracing: spans are written to stdout, appended to a file or not exported at all
+type Tracing struct {
+	Exporter    string  `yaml:"exporter" json:"exporter" env:"TRACING_EXPORTER"`
+	File        string  `yaml:"file" json:"file"`
+	SampleRatio float64 `yaml:"sample_ratio" json:"sample_ratio"`
+}
+
+// Probes: timeout of every dependency check, how long readiness fails before listeners
+// are closed on shutdown, so that load balancers stop routing traffic first, and how long
+// probes reuse the results of the checks, zero checking on every probe
+type Health struct {
+	Timeout    time.Duration `yaml:"timeout" json:"timeout"`
+	DrainDelay time.Duration `yaml:"drain_delay" json:"drain_delay"`
+	CacheTTL   time.Duration `yaml:"cache_ttl" json:"cache_ttl"`
+}
+
+// How often the configuration file is checked for changes, zero leaves reloads to SIGHUP
+type Reload struct {
+	Interval time.Duration `yaml:"interval" json:"interval"`
+}
+
+// Storage backend selected by driver, each driver reads its own section
 type Database struct {
-	DSN string `yaml:"dsn" json:"dsn"`
+	Driver string `yaml:"driver" json:"driver" env:"DATABASE_DRIVER"`
+	DSN    string `yaml:"dsn" json:"dsn" env:"DATABASE_DSN"`
+	SQLite SQLite `yaml:"sqlite" json:"sqlite"`
+	Memory Memory `yaml:"memory" json:"memory"`
+}
+
+// SQLite connections: write-ahead logging, how long a locked database is waited for and the pool size (zero is unlimited)
+type SQLite struct {
+	WAL          bool          `yaml:"wal" json:"wal"`
+	BusyTimeout  time.Duration `yaml:"busy_timeout" json:"busy_timeout"`
+	MaxOpenConns int           `yaml:"max_open_conns" json:"max_open_conns"`
 }
 
-func NewConfig(configPath string) (*Config, error) {
-	var config = new(Config)
+// Books kept in memory are lost on exit, unless written to the snapshot file on shutdown and
+// every snapshot_interval (zero only on shutdown). With wal changes made since the last snapshot survive a crash.
+type Memory struct {
+	SnapshotFile     string        `yaml:"snapshot_file" json:"snapshot_file"`
+	SnapshotInterval time.Duration `yaml:"snapshot_interval" json:"snapshot_interval"`
+	WAL              bool          `yaml:"wal" json:"wal"`
+}
+
+// How tokens are resolved: "remote" asks the user service, "jwt" verifies signed tokens locally
+type Auth struct {
+	Mode string `yaml:"mode" json:"mode" env:"AUTH_MODE"`
+	JWT  JWT    `yaml:"jwt" json:"jwt"`
+}
 
-	file, err := os.ReadFile(configPath)
-	if err != nil {
-		return nil, err
+// Local JWT verification, keys are taken from every configured source
+type JWT struct {
+	HMACSecret       string        `yaml:"hmac_secret" json:"-" env:"JWT_HMAC_SECRET"`
+	PublicKeyFile    string        `yaml:"public_key_file" json:"public_key_file"`
+	JWKSFile         string        `yaml:"jwks_file" json:"jwks_file"`
+	Issuer           string        `yaml:"issuer" json:"issuer"`
+	Audience         string        `yaml:"audience" json:"audience"`
+	PermissionsClaim string        `yaml:"permissions_claim" json:"permissions_claim"`
+	Leeway           time.Duration `yaml:"leeway" json:"leeway"`
+}
+
+// Resilience of calls to the user service
+type UserClient struct {
+	Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	// Zero sends every request once
+	Retries    int           `yaml:"retries" json:"retries"`
+	Backoff    time.Duration `yaml:"backoff" json:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff" json:"max_backoff"`
+	// Zero turns the circuit breaker off
+	BreakerThreshold int           `yaml:"breaker_threshold" json:"breaker_threshold"`
+	BreakerCooldown  time.Duration `yaml:"breaker_cooldown" json:"breaker_cooldown"`
+}
+
+// Cache of permission masks returned by the user service
+type UserCache struct {
+	TTL         time.Duration `yaml:"ttl" json:"ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl" json:"negative_ttl"`
+	Size        int           `yaml:"size" json:"size"`
+}
+
+// Limits per client of read and write routes
+type RateLimits struct {
+	// Per address, checked before the token is resolved
+	IP    RateLimit `yaml:"ip" json:"ip"`
+	Read  RateLimit `yaml:"read" json:"read"`
+	Write RateLimit `yaml:"write" json:"write"`
+}
+
+// Token bucket: rate requests per second with bursts of up to burst requests, zero rate disables the limit
+type RateLimit struct {
+	Rate  float64 `yaml:"rate" json:"rate"`
+	Burst int     `yaml:"burst" json:"burst"`
+}
+
+// OAI-PMH provider settings
+type OAI struct {
+	RepositoryName string `yaml:"repository_name" json:"repository_name"`
+	BaseURL        string `yaml:"base_url" json:"base_url"`
+	AdminEmail     string `yaml:"admin_email" json:"admin_email"`
+	Identifier     string `yaml:"identifier" json:"identifier"`
+	PageSize       int    `yaml:"page_size" json:"page_size"`
+}
+
+// DefaultConfig returns the settings used for everything the file, environment and flags leave out
+func DefaultConfig() *Config {
+	return &Config{
+		Host:             "127.0.0.1",
+		Port:             "8080",
+		UserHost:         "127.0.0.1",
+		UserInternalPort: "8081",
+		Server: Server{
+			ReadHeaderTimeout: 5 * time.Second,
+			ReadTimeout:       30 * time.Second,
+			// Exports of the whole catalogue are streamed for a while
+			WriteTimeout:    2 * time.Minute,
+			IdleTimeout:     2 * time.Minute,
+			MaxHeaderBytes:  1 << 20,
+			MaxBodyBytes:    1 << 20,
+			MaxImportBytes:  32 << 20,
+			ShutdownTimeout: 15 * time.Second,
+			TLS:             TLS{ClientAuth: "none"},
+		},
+		Auth: Auth{
+			Mode: "remote",
+			JWT: JWT{
+				PermissionsClaim: library.DefaultPermissionsClaim,
+				Leeway:           30 * time.Second,
+			},
+		},
+		UserClient: UserClient{
+			Timeout:          library.DefaultUserTimeout,
+			Retries:          library.DefaultUserRetries,
+			Backoff:          library.DefaultUserBackoff,
+			MaxBackoff:       library.DefaultUserMaxBackoff,
+			BreakerThreshold: library.DefaultBreakerThreshold,
+			BreakerCooldown:  library.DefaultBreakerCooldown,
+		},
+		UserCache: UserCache{
+			TTL:         library.DefaultCacheTTL,
+			NegativeTTL: library.DefaultCacheNegativeTTL,
+			Size:        library.DefaultCacheSize,
+		},
+		Log:     Log{Level: "info", Format: "text"},
+		Tracing: Tracing{Exporter: "none", SampleRatio: 1},
+		Health:  Health{Timeout: health.DefaultTimeout, CacheTTL: health.DefaultCacheTTL},
+		Reload:  Reload{Interval: 5 * time.Second},
+		DB: Database{
+			Driver: "sqlite",
+			DSN:    "db/books.db",
+			SQLite: SQLite{BusyTimeout: 5 * time.Second},
+			Memory: Memory{SnapshotInterval: time.Minute},
+		},
+		OAI: OAI{RepositoryName: "Book service", Identifier: "book-service", PageSize: 100},
 	}
+}
 
-	err = yaml.Unmarshal(file, config)
-	if err != nil {
-		return nil, err
+// Validate checks every setting and reports all invalid ones at once
+func (c *Config) Validate() error {
+	var problems ConfigError
+	invalid := func(field, format string, args ...any) {
+		problems = append(problems, FieldError{Field: field, Problem: fmt.Sprintf(format, args...)})
+	}
+	oneOf := func(field, value string, allowed ...string) {
+		if !slices.Contains(allowed, value) {
+			invalid(field, "%q is not one of %s", value, strings.Join(allowed, ", "))
+		}
+	}
+	port := func(field, value string) {
+		if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+			invalid(field, "%q is not a port number", value)
+		}
 	}
 
-	return config, nil
+	port("port", c.Port)
+	tls := c.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		invalid("server.tls", "cert_file and key_file are required together")
+	}
+	oneOf("server.tls.client_auth", tls.ClientAuth, "none", "verify_if_given", "require")
+	if tls.ClientAuth != "none" && (tls.ClientCAFile == "" || tls.CertFile == "") {
+		invalid("server.tls.client_auth", "%s requires client_ca_file, cert_file and key_file", tls.ClientAuth)
+	}
+	oneOf("auth.mode", c.Auth.Mode, "remote", "jwt")
+	switch c.Auth.Mode {
+	case "remote":
+		if c.UserHost == "" {
+			invalid("user_host", "is required with auth.mode remote")
+		}
+		port("user_internal_port", c.UserInternalPort)
+	case "jwt":
+		if c.Auth.JWT.HMACSecret == "" && c.Auth.JWT.PublicKeyFile == "" && c.Auth.JWT.JWKSFile == "" {
+			invalid("auth.jwt", "one of hmac_secret, public_key_file and jwks_file is required with auth.mode jwt")
+		}
+	}
+	oneOf("log.level", strings.ToLower(c.Log.Level), "debug", "info", "warn", "error")
+	oneOf("log.format", c.Log.Format, "text", "json")
+	oneOf("tracing.exporter", c.Tracing.Exporter, "none", "stdout", "file")
+	if c.Tracing.Exporter == "file" && c.Tracing.File == "" {
+		invalid("tracing.file", "is required with tracing.exporter file")
+	}
+	if c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sample_ratio", "%v is greater than 1", c.Tracing.SampleRatio)
+	}
+	if c.Server.ShutdownTimeout > 0 && c.Health.DrainDelay >= c.Server.ShutdownTimeout {
+		invalid("health.drain_delay", "%v leaves no time to drain requests within server.shutdown_timeout %v",
+			c.Health.DrainDelay, c.Server.ShutdownTimeout)
+	}
+	oneOf("database.driver", c.DB.Driver, storage.Drivers()...)
+	if c.DB.Driver == "sqlite" && c.DB.DSN == "" {
+		invalid("database.dsn", "is required with database.driver sqlite")
+	}
+	if c.DB.Memory.WAL && c.DB.Memory.SnapshotFile == "" {
+		invalid("database.memory.wal", "requires database.memory.snapshot_file, the log is kept next to it")
+	}
+
+	// Numbers and durations are never meaningful below zero
+	walkConfig(reflect.ValueOf(c).Elem(), "", func(path string, _ reflect.StructField, value reflect.Value) {
+		switch value.Kind() {
+		case reflect.Int, reflect.Int64:
+			if value.Int() < 0 {
+				invalid(path, "%v is negative", value.Interface())
+			}
+		case reflect.Float64:
+			if value.Float() < 0 {
+				invalid(path, "%v is negative", value.Float())
+			}
+		}
+	})
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
 }
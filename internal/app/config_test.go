@@ -0,0 +1,121 @@
+package app
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadConfig(t *testing.T, args ...string) (*Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := NewConfigLoader(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return loader.Load()
+}
+
+func TestConfigLoader_layers(t *testing.T) {
+	path := writeConfig(t, `
+port: "9000"
+log:
+  format: json
+rate_limit:
+  read:
+    rate: 10
+`)
+	t.Setenv("CONFIG_PATH", path)
+	t.Setenv("SERVER_PORT", "9001")
+	t.Setenv("LOG_LEVEL", "debug")
+
+	config, err := loadConfig(t, "-port", "9002", "-rate_limit.read.rate", "2.5", "-user_cache.ttl", "1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks := []struct {
+		name      string
+		got, want any
+	}{
+		{"flag over env", config.Port, "9002"},
+		{"env over file", config.Log.Level, "debug"},
+		{"file over default", config.Log.Format, "json"},
+		{"default", config.UserCache.Size, library.DefaultCacheSize},
+		{"float flag", config.RateLimit.Read.Rate, 2.5},
+		{"duration flag", config.UserCache.TTL, time.Minute},
+	}
+	for _, c := range checks {
+		if c.got != c.want {
+			t.Errorf("%s: want %v, got %v", c.name, c.want, c.got)
+		}
+	}
+
+	// The flag names the file rather than the environment
+	other := writeConfig(t, `host: "0.0.0.0"`)
+	config, err = loadConfig(t, "-config", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "0.0.0.0" || config.Port != "9001" {
+		t.Errorf("want host from -config and port from env, got %s:%s", config.Host, config.Port)
+	}
+}
+
+func TestConfigLoader_invalid(t *testing.T) {
+	t.Setenv("CONFIG_PATH", writeConfig(t, `
+auth:
+  mode: jwt
+tracing:
+  exporter: file
+`))
+	t.Setenv("USER_INTERNAL_PORT", "http")
+
+	_, err := loadConfig(t, "-port", "99999", "-user_cache.size", "-1", "-health.timeout", "soon")
+	var configErr ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("want ConfigError, got %v", err)
+	}
+
+	// Every problem is reported at once, malformed values first
+	want := []string{"health.timeout", "port", "auth.jwt", "tracing.file", "user_cache.size"}
+	var got []string
+	for _, fe := range configErr {
+		got = append(got, fe.Field)
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("want invalid fields %v, got %v", want, got)
+	}
+	if !strings.Contains(err.Error(), `port: "99999" is not a port number`) {
+		t.Errorf("want readable message, got %q", err)
+	}
+
+	// Typos in the file are not silently ignored
+	t.Setenv("CONFIG_PATH", writeConfig(t, `rate_limits: {}`))
+	if _, err := loadConfig(t); err == nil || !strings.Contains(err.Error(), "rate_limits") {
+		t.Errorf("want unknown key rejected, got %v", err)
+	}
+}
+
+func TestNewUserClient_zero(t *testing.T) {
+	t.Setenv("CONFIG_PATH", writeConfig(t, "user_client:\n  retries: 0\n  breaker_threshold: 0\n"))
+	config, err := loadConfig(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client := newUserClient(config); client.Retries != 0 {
+		t.Errorf("want retries turned off, got %d", client.Retries)
+	}
+}
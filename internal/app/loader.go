@@ -0,0 +1,193 @@
+package app
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultConfigPath is read when neither -config nor CONFIG_PATH name another file
+const DefaultConfigPath = "configs/config.yml"
+
+// Environment variable naming the configuration file
+const configPathEnv = "CONFIG_PATH"
+
+// FieldError is an invalid setting
+type FieldError struct {
+	// Field is the dotted path of the setting in the YAML file, e.g. rate_limit.read.rate
+	Field   string
+	Problem string
+}
+
+// ConfigError lists every invalid setting
+type ConfigError []FieldError
+
+func (e ConfigError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("invalid configuration:")
+	for _, fe := range e {
+		fmt.Fprintf(&sb, "\n  %s: %s", fe.Field, fe.Problem)
+	}
+	return sb.String()
+}
+
+// A setting given on the command line
+type override struct {
+	path  string
+	value string
+}
+
+// ConfigLoader builds the configuration in layers, each overriding the one before:
+// defaults, the YAML file, environment variables named by env tags and command line flags
+type ConfigLoader struct {
+	path      string
+	overrides []override
+}
+
+// NewConfigLoader registers -config and a flag for every setting, named by its dotted
+// YAML path (e.g. -rate_limit.read.rate), on the flag set. Secrets, hidden from JSON,
+// get no flag so that they don't show up in the process list.
+func NewConfigLoader(fs *flag.FlagSet) *ConfigLoader {
+	l := &ConfigLoader{}
+	fs.StringVar(&l.path, "config", "", fmt.Sprintf("configuration file (env %s, default %s)", configPathEnv, DefaultConfigPath))
+
+	defaults := DefaultConfig()
+	walkConfig(reflect.ValueOf(defaults).Elem(), "", func(path string, field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("json") == "-" {
+			return
+		}
+		usage := "sets " + path
+		if env := field.Tag.Get("env"); env != "" {
+			usage += " (env " + env + ")"
+		}
+		fs.Func(path, usage, func(value string) error {
+			l.overrides = append(l.overrides, override{path: path, value: value})
+			return nil
+		})
+	})
+	return l
+}
+
+// Path of the configuration file
+func (l *ConfigLoader) Path() string {
+	if l.path != "" {
+		return l.path
+	}
+	if path, ok := os.LookupEnv(configPathEnv); ok && path != "" {
+		return path
+	}
+	return DefaultConfigPath
+}
+
+// Load reads the configuration afresh, the flag set must have been parsed before
+func (l *ConfigLoader) Load() (*Config, error) {
+	config := DefaultConfig()
+
+	file, err := os.ReadFile(l.Path())
+	if err != nil {
+		return nil, err
+	}
+	// Unknown keys are most likely typos, which would silently keep the default
+	decoder := yaml.NewDecoder(bytes.NewReader(file))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", l.Path(), err)
+	}
+
+	// Malformed values are listed along with the invalid ones
+	var problems ConfigError
+	root := reflect.ValueOf(config).Elem()
+	walkConfig(root, "", func(path string, field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+		if env == "" {
+			return
+		}
+		if raw, ok := os.LookupEnv(env); ok {
+			if err := setField(value, raw); err != nil {
+				problems = append(problems, FieldError{Field: path, Problem: fmt.Sprintf("%s: %v", env, err)})
+			}
+		}
+	})
+
+	fields := make(map[string]reflect.Value)
+	walkConfig(root, "", func(path string, _ reflect.StructField, value reflect.Value) {
+		fields[path] = value
+	})
+	for _, o := range l.overrides {
+		if err := setField(fields[o.path], o.value); err != nil {
+			problems = append(problems, FieldError{Field: o.path, Problem: fmt.Sprintf("-%s: %v", o.path, err)})
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		problems = append(problems, err.(ConfigError)...)
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return config, nil
+}
+
+// Visit every setting of the configuration along with its dotted YAML path
+func walkConfig(v reflect.Value, prefix string, fn func(path string, field reflect.StructField, value reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		path := prefix + name
+		if field.Type.Kind() == reflect.Struct {
+			walkConfig(v.Field(i), path+".", fn)
+			continue
+		}
+		fn(path, field, v.Field(i))
+	}
+}
+
+// Parse the text into the setting the way YAML would
+func setField(value reflect.Value, raw string) error {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", raw)
+		}
+		value.SetInt(int64(d))
+		return nil
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		value.SetInt(int64(n))
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		value.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		value.SetBool(b)
+	default:
+		return fmt.Errorf("settings of type %s can't be overridden", value.Type())
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+// Settings Reload applies to the running service, a trailing dot covers a whole section.
+// Everything else, like the listen address or the database, needs a restart.
+var reloadable = []string{
+	"log.level",
+	"rate_limit.",
+	"user_host",
+	"user_internal_port",
+	"user_client.",
+	"user_cache.ttl",
+	"user_cache.negative_ttl",
+	"reload.interval",
+}
+
+func isReloadable(path string) bool {
+	for _, prefix := range reloadable {
+		if path == prefix || strings.HasSuffix(prefix, ".") && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReloadStatus is the outcome of configuration reloads, reported by /status
+type ReloadStatus struct {
+	Path         string     `json:"path"`
+	LoadedAt     time.Time  `json:"loaded_at"`
+	Reloads      int        `json:"reloads"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastFailedAt *time.Time `json:"last_failed_at,omitempty"`
+}
+
+// Reload state, the mutex serializes reloads triggered by the file and by signals
+type reloader struct {
+	loader *ConfigLoader
+
+	mu      sync.Mutex
+	applied *Config
+	status  ReloadStatus
+}
+
+// WatchConfig makes the configuration reloadable from the loader it was loaded with.
+// Once the app is started, the file is reloaded when its content changes and on SIGHUP.
+// It must be called after Setup.
+func (a *App) WatchConfig(loader *ConfigLoader) {
+	a.reload = &reloader{
+		loader:  loader,
+		applied: a.config,
+		status:  ReloadStatus{Path: loader.Path(), LoadedAt: time.Now().UTC()},
+	}
+	a.health.Detail("config", func() any {
+		a.reload.mu.Lock()
+		defer a.reload.mu.Unlock()
+		return a.reload.status
+	})
+}
+
+// Reload loads the configuration again and applies the changed settings. An invalid
+// configuration or a change of a setting that needs a restart is rejected as a whole.
+func (a *App) Reload() error {
+	if a.reload == nil {
+		return fmt.Errorf("configuration is not watched")
+	}
+	r := a.reload
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	config, err := r.loader.Load()
+	var changed []string
+	if err == nil {
+		changed = changedSettings(r.applied, config)
+		var rejected ConfigError
+		for _, path := range changed {
+			if !isReloadable(path) {
+				rejected = append(rejected, FieldError{Field: path, Problem: "can't be changed without a restart"})
+			}
+		}
+		if len(rejected) > 0 {
+			err = rejected
+		}
+	}
+	if err != nil {
+		now := time.Now().UTC()
+		r.status.LastError, r.status.LastFailedAt = err.Error(), &now
+		a.logger.Error("configuration not reloaded", "path", r.status.Path, "error", err)
+		return err
+	}
+	if len(changed) == 0 {
+		a.logger.Debug("configuration unchanged", "path", r.status.Path)
+		return nil
+	}
+
+	if err := a.apply(config, changed); err != nil {
+		now := time.Now().UTC()
+		r.status.LastError, r.status.LastFailedAt = err.Error(), &now
+		a.logger.Error("configuration not reloaded", "path", r.status.Path, "error", err)
+		return err
+	}
+	r.applied = config
+	r.status.LoadedAt = time.Now().UTC()
+	r.status.Reloads++
+	r.status.LastError, r.status.LastFailedAt = "", nil
+	a.logger.Info("configuration reloaded", "path", r.status.Path, "changed", changed)
+	return nil
+}
+
+// Swap the reloadable parts of the service, the settings are known to be valid
+func (a *App) apply(config *Config, changed []string) error {
+	changedAny := func(prefixes ...string) bool {
+		for _, path := range changed {
+			for _, prefix := range prefixes {
+				if strings.HasPrefix(path, prefix) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if changedAny("log.level") {
+		if err := setLogLevel(a.logLevel, config.Log.Level); err != nil {
+			return err
+		}
+	}
+	if changedAny("rate_limit.") {
+		a.ipLimit.SetLimit(library.RateLimit{Rate: config.RateLimit.IP.Rate, Burst: config.RateLimit.IP.Burst})
+		a.readLimit.SetLimit(library.RateLimit{Rate: config.RateLimit.Read.Rate, Burst: config.RateLimit.Read.Burst})
+		a.writeLimit.SetLimit(library.RateLimit{Rate: config.RateLimit.Write.Rate, Burst: config.RateLimit.Write.Burst})
+	}
+	// Without the user service, e.g. with auth.mode jwt, its settings have nothing to apply to
+	if a.userClient != nil && changedAny("user_host", "user_internal_port", "user_client.") {
+		a.userClient.Store(newUserClient(config))
+	}
+	if a.users != nil && changedAny("user_cache.") {
+		ttl, negativeTTL := config.UserCache.TTL, config.UserCache.NegativeTTL
+		if ttl <= 0 {
+			ttl = library.DefaultCacheTTL
+		}
+		if negativeTTL <= 0 {
+			negativeTTL = library.DefaultCacheNegativeTTL
+		}
+		a.users.SetTTL(ttl, negativeTTL)
+	}
+	return nil
+}
+
+// Dotted paths of the settings that differ between the configurations
+func changedSettings(old, new *Config) []string {
+	before := make(map[string]any)
+	walkConfig(reflect.ValueOf(old).Elem(), "", func(path string, _ reflect.StructField, value reflect.Value) {
+		before[path] = value.Interface()
+	})
+	var changed []string
+	walkConfig(reflect.ValueOf(new).Elem(), "", func(path string, _ reflect.StructField, value reflect.Value) {
+		if before[path] != value.Interface() {
+			changed = append(changed, path)
+		}
+	})
+	return changed
+}
+
+// Reload on SIGHUP and whenever the content of the file changes, until the context is done
+func (a *App) watchConfig(ctx context.Context) error {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	// Changes are detected by content, editors don't reliably update the modification time
+	digest := func() [sha256.Size]byte {
+		data, _ := os.ReadFile(a.reload.loader.Path())
+		return sha256.Sum256(data)
+	}
+	last := digest()
+
+	for {
+		// The interval is read every time, since a reload may change it
+		var tick <-chan time.Time
+		var timer *time.Timer
+		if interval := a.reloadInterval(); interval > 0 {
+			timer = time.NewTimer(interval)
+			tick = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hangup:
+			a.logger.Info("reloading configuration on SIGHUP")
+			last = digest()
+			_ = a.Reload()
+		case <-tick:
+			// A rejected file isn't reported again until it changes once more
+			if current := digest(); current != last {
+				last = current
+				_ = a.Reload()
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (a *App) reloadInterval() time.Duration {
+	a.reload.mu.Lock()
+	defer a.reload.mu.Unlock()
+	return a.reload.applied.Reload.Interval
+}
+
+// Client of the user service replaceable while requests are served
+type userClientSwitch struct {
+	current atomic.Pointer[library.UserServiceClient]
+}
+
+func newUserClientSwitch(client *library.UserServiceClient) *userClientSwitch {
+	s := &userClientSwitch{}
+	s.current.Store(client)
+	return s
+}
+
+// Store replaces the client, requests in flight finish with the old one
+func (s *userClientSwitch) Store(client *library.UserServiceClient) {
+	s.current.Store(client)
+}
+
+func (s *userClientSwitch) Authenticate(ctx context.Context, token string) (*library.Principal, error) {
+	return s.current.Load().Authenticate(ctx, token)
+}
+
+// Ping checks the user service through the current client
+func (s *userClientSwitch) Ping(ctx context.Context) error {
+	return s.current.Load().Ping(ctx)
+}
+
+// CloseIdleConnections releases the connections kept open by the current client
+func (s *userClientSwitch) CloseIdleConnections() {
+	s.current.Load().HTTPClient.CloseIdleConnections()
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/health"
+)
+
+func TestApp_Reload(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "books.db")
+	settings := func(port, level string, rate float64, ttl time.Duration) string {
+		return fmt.Sprintf(`
+port: %q
+log:
+  level: %s
+rate_limit:
+  read:
+    rate: %v
+user_cache:
+  ttl: %s
+database:
+  dsn: %q
+`, port, level, rate, ttl, dsn)
+	}
+	path := writeConfig(t, settings("9000", "info", 0, time.Minute))
+	t.Setenv("CONFIG_PATH", path)
+
+	loader := NewConfigLoader(flag.NewFlagSet("test", flag.ContinueOnError))
+	config, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+	a, err := New(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	if err := a.Setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	a.WatchConfig(loader)
+	client := a.userClient.current.Load()
+
+	// Reloadable settings are swapped in place
+	if err := os.WriteFile(path, []byte(settings("9000", "debug", 5, 2*time.Minute)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.logLevel.Level() != slog.LevelDebug {
+		t.Errorf("want log level debug, got %v", a.logLevel.Level())
+	}
+	if limit := a.readLimit.Limit(); limit.Rate != 5 {
+		t.Errorf("want read rate 5, got %v", limit.Rate)
+	}
+	if ttl, _ := a.users.TTL(); ttl != 2*time.Minute {
+		t.Errorf("want cache TTL 2m, got %v", ttl)
+	}
+	if a.userClient.current.Load() != client {
+		t.Error("want user service client kept while its settings are unchanged")
+	}
+
+	// A change needing a restart rejects the whole file
+	if err := os.WriteFile(path, []byte(settings("9001", "warn", 5, 2*time.Minute)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	err = a.Reload()
+	var configErr ConfigError
+	if !errors.As(err, &configErr) || len(configErr) != 1 || configErr[0].Field != "port" {
+		t.Fatalf("want port change rejected, got %v", err)
+	}
+	if a.logLevel.Level() != slog.LevelDebug {
+		t.Errorf("want log level kept after rejected reload, got %v", a.logLevel.Level())
+	}
+
+	rr := httptest.NewRecorder()
+	a.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var status struct {
+		health.Status
+		Details struct {
+			Config ReloadStatus `json:"config"`
+		} `json:"details"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	reload := status.Details.Config
+	if reload.Path != path || reload.Reloads != 1 || reload.LastFailedAt == nil ||
+		!strings.Contains(reload.LastError, "port: can't be changed without a restart") {
+		t.Errorf("wrong reload status: %+v", reload)
+	}
+
+	// A new address gets a new client
+	t.Setenv("USER_HOST", "192.0.2.1")
+	if err := os.WriteFile(path, []byte(settings("9000", "debug", 5, 2*time.Minute)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.userClient.current.Load() == client {
+		t.Error("want user service client replaced")
+	}
+}
+
+func TestChangedSettings(t *testing.T) {
+	old, new := DefaultConfig(), DefaultConfig()
+	new.RateLimit.Write.Burst = 3
+	new.Auth.JWT.HMACSecret = "secret"
+
+	got := strings.Join(changedSettings(old, new), " ")
+	if want := "auth.jwt.hmac_secret rate_limit.write.burst"; got != want {
+		t.Errorf("want changed %q, got %q", want, got)
+	}
+	for path, want := range map[string]bool{
+		"rate_limit.write.burst": true,
+		"log.level":              true,
+		"log.format":             false,
+		"user_cache.size":        false,
+		"user_host":              true,
+		"user_hostname":          false,
+	} {
+		if got := isReloadable(path); got != want {
+			t.Errorf("%s: want reloadable %v, got %v", path, want, got)
+		}
+	}
+}
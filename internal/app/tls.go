@@ -0,0 +1,128 @@
+package app
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Key pair read again whenever either file changes, so that renewed certificates are served without a restart
+type certificate struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func loadCertificate(certFile, keyFile string) (*certificate, error) {
+	c := &certificate{certFile: certFile, keyFile: keyFile}
+	modified, err := c.lastModified()
+	if err != nil {
+		return nil, errors.Wrap(err, oops.ErrTLS.Error())
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, oops.ErrTLS.Error())
+	}
+	c.cert, c.modified = &cert, modified
+	return c, nil
+}
+
+// Latest modification time of the files
+func (c *certificate) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate serves the current certificate. A pair that fails to load, e.g. while
+// the files are half written, is reported and the previous certificate is kept.
+func (c *certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modified, err := c.lastModified()
+	if err != nil || modified.Equal(c.modified) {
+		return c.cert, nil
+	}
+	// A failed pair is reported once, until the files change again
+	c.modified = modified
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		slog.Error("certificate not reloaded", "cert_file", c.certFile, "error", err)
+		return c.cert, nil
+	}
+	c.cert = &cert
+	slog.Info("certificate reloaded", "cert_file", c.certFile)
+	return c.cert, nil
+}
+
+// TLS settings of the server, nil when TLS is off
+func tlsConfig(cfg TLS) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := loadCertificate(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cert.GetCertificate,
+	}
+
+	switch cfg.ClientAuth {
+	case "", "none":
+		return config, nil
+	case "verify_if_given":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, errors.Wrapf(oops.ErrTLS, "unknown client auth %q", cfg.ClientAuth)
+	}
+
+	pem, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, errors.Wrap(err, oops.ErrTLS.Error())
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.Wrapf(oops.ErrTLS, "no certificates in %s", cfg.ClientCAFile)
+	}
+	return config, nil
+}
+
+// Listener of the server, on the Unix socket if one is configured
+func listen(cfg Server, addr string) (net.Listener, error) {
+	if cfg.Socket == "" {
+		ln, err := net.Listen("tcp", addr)
+		return ln, errors.Wrap(err, oops.ErrListen.Error())
+	}
+
+	// A socket left behind by a process that was killed would fail the bind, other files are never removed
+	if info, err := os.Lstat(cfg.Socket); err == nil && info.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(cfg.Socket); err != nil {
+			return nil, errors.Wrap(err, oops.ErrListen.Error())
+		}
+	}
+	ln, err := net.Listen("unix", cfg.Socket)
+	return ln, errors.Wrap(err, oops.ErrListen.Error())
+}
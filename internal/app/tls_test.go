@@ -0,0 +1,197 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Certificate signed by the parent, or self-signed without one
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// Write the certificate and key as PEM files named after the prefix
+func (c *testCert) write(t *testing.T, prefix string) (certFile, keyFile string) {
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = prefix+".crt", prefix+".key"
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil)
+	caFile, _ := ca.write(t, filepath.Join(dir, "ca"))
+	certFile, keyFile := newTestCert(t, "server", ca).write(t, filepath.Join(dir, "server"))
+
+	config, err := tlsConfig(TLS{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, ClientAuth: "require"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := listen(Server{}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{TLSConfig: config, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	})}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() { server.Close() })
+
+	get := func(clientCerts ...tls.Certificate) (*http.Response, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: clientCerts},
+		}}
+		return client.Get("https://" + ln.Addr().String())
+	}
+
+	// Internal callers are told apart by their certificates
+	resp, err := get(newTestCert(t, "internal", ca).tlsCertificate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("with client certificate: want status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if _, err := get(); err == nil {
+		t.Error("want callers without certificate rejected")
+	}
+	if _, err := get(newTestCert(t, "stranger", nil).tlsCertificate()); err == nil {
+		t.Error("want certificates of other authorities rejected")
+	}
+
+	if _, err := tlsConfig(TLS{CertFile: certFile, KeyFile: caFile}); err == nil {
+		t.Error("want mismatched key rejected")
+	}
+}
+
+func TestCertificate_reload(t *testing.T) {
+	prefix := filepath.Join(t.TempDir(), "server")
+	first := newTestCert(t, "first", nil)
+	certFile, keyFile := first.write(t, prefix)
+
+	cert, err := loadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := func() string {
+		got, err := cert.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, _ := x509.ParseCertificate(got.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+
+	// A half written pair keeps the previous certificate
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(keyFile, []byte("garbage"), 0o600)
+	os.Chtimes(keyFile, later, later)
+	if got := served(); got != "first" {
+		t.Errorf("want first certificate kept, got %s", got)
+	}
+
+	newTestCert(t, "renewed", nil).write(t, prefix)
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if got := served(); got != "renewed" {
+		t.Errorf("want renewed certificate served, got %s", got)
+	}
+}
+
+func TestListen_socket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "books.sock")
+
+	// A socket left behind by a killed process is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(Server{Socket: path}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://book-service/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Other files are never removed
+	file := filepath.Join(t.TempDir(), "books.db")
+	os.WriteFile(file, nil, 0o644)
+	if _, err := listen(Server{Socket: file}, ""); err == nil {
+		t.Error("want regular file kept and listening failed")
+	}
+}
@@ -0,0 +1,132 @@
+// Package fakeuser is a stand-in for the user microservice. It answers the
+// permission lookups of library.UserServiceClient from a fixed token table,
+// for local development and end-to-end tests.
+package fakeuser
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"gopkg.in/yaml.v3"
+)
+
+// Token is a row of the token table
+type Token struct {
+	Token       string      `yaml:"token"`
+	UserID      string      `yaml:"user_id"`
+	Permissions Permissions `yaml:"permissions"`
+}
+
+// Permissions is a permission mask, given in YAML either as a number
+// or as a list of names like "ManageBooks"
+type Permissions uint
+
+func (p *Permissions) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		mask, err := strconv.ParseUint(node.Value, 0, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.Line, err)
+		}
+		*p = Permissions(mask)
+		return nil
+	}
+
+	var names []string
+	if err := node.Decode(&names); err != nil {
+		return err
+	}
+	var mask uint
+	for _, name := range names {
+		perm, err := library.ParsePermission(name)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", node.Line, err)
+		}
+		mask |= perm
+	}
+	*p = Permissions(mask)
+	return nil
+}
+
+// Server answers POST /user/permissions like the user service does
+type Server struct {
+	mu     sync.RWMutex
+	tokens map[string]Token
+}
+
+func New(tokens ...Token) *Server {
+	s := &Server{tokens: make(map[string]Token)}
+	for _, token := range tokens {
+		s.Set(token)
+	}
+	return s
+}
+
+// Load reads the token table from a YAML file with a "tokens" list
+func Load(path string) (*Server, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Tokens []Token `yaml:"tokens"`
+	}
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return New(file.Tokens...), nil
+}
+
+// Set adds the token or replaces its row
+func (s *Server) Set(token Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Token] = token
+}
+
+// Revoke removes the token, later lookups are rejected
+func (s *Server) Revoke(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, token)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/user/permissions" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	token, ok := s.tokens[req.Token]
+	s.mu.RUnlock()
+	if !ok {
+		http.Error(w, "Unknown token", http.StatusUnauthorized)
+		return
+	}
+
+	// The mask is sent as a string under the misspelt key, as the user service does
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"user_id":    token.UserID,
+		"permissios": strconv.FormatUint(uint64(token.Permissions), 10),
+	})
+}
@@ -0,0 +1,80 @@
+package fakeuser_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/fakeuser"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+)
+
+const tokens = `
+tokens:
+  - token: librarian
+    user_id: "1"
+    permissions: [ManageBooks, LoanBooks]
+  - token: reader
+    user_id: "2"
+    permissions: 64
+`
+
+// Book handler talking to the fake user service through the real HTTP client
+func TestEndToEnd(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yml")
+	if err := os.WriteFile(path, []byte(tokens), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	users, err := fakeuser.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(users)
+	defer server.Close()
+
+	client := library.NewUserServiceClient(strings.TrimPrefix(server.URL, "http://"))
+	router := chi.NewRouter()
+	library.NewHandler(router, library.NewBookService(memory.NewMemoryBookStore()), client).Register()
+
+	create := func(token string) int {
+		body := bytes.NewBufferString(`{"id": "1", "title": "Go Programming Language"}`)
+		req, err := http.NewRequest(http.MethodPost, "/api/v1/books/new", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"without permission", "reader", http.StatusForbidden},
+		{"unknown token", "stranger", http.StatusUnauthorized},
+		{"librarian", "librarian", http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := create(tt.token); got != tt.want {
+				t.Errorf("want status %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("revoked", func(t *testing.T) {
+		users.Revoke("librarian")
+		if got := create("librarian"); got != http.StatusUnauthorized {
+			t.Errorf("want status %d, got %d", http.StatusUnauthorized, got)
+		}
+	})
+}
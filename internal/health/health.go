@@ -0,0 +1,228 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// DefaultTimeout bounds every dependency check, so that a hanging dependency doesn't hang the probe
+const DefaultTimeout = 2 * time.Second
+
+// DefaultCacheTTL is how long probes reuse the results of the last checks, so that
+// frequent probes don't load the dependencies
+const DefaultCacheTTL = time.Second
+
+// Check reports whether a dependency works, nil meaning it does
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker answers liveness, readiness and status probes
+type Checker struct {
+	version  string
+	started  time.Time
+	timeout  time.Duration
+	cacheTTL time.Duration
+	logger   *slog.Logger
+	checks   []namedCheck
+	details  map[string]func() any
+
+	// Results of the last checks, concurrent probes wait for a single run
+	mu        sync.Mutex
+	results   map[string]CheckResult
+	checkedAt time.Time
+
+	shuttingDown atomic.Bool
+}
+
+// Option configures a Checker
+type Option func(*Checker)
+
+// WithCacheTTL sets how long the results of the checks are reused, zero runs them on every probe
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(c *Checker) { c.cacheTTL = ttl }
+}
+
+// WithLogger sets the logger failing checks are reported to, the probes only name them
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Checker) { c.logger = logger }
+}
+
+// New creates a checker of a service of the given version, started now.
+// A zero timeout means DefaultTimeout.
+func New(version string, timeout time.Duration, opts ...Option) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	c := &Checker{version: version, started: time.Now(), timeout: timeout, cacheTTL: DefaultCacheTTL, logger: slog.Default()}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Add makes readiness depend on the check
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Detail adds the state of a component, e.g. of configuration reloads, to the status.
+// The function is called on every request and its result is encoded as JSON.
+func (c *Checker) Detail(name string, detail func() any) {
+	if c.details == nil {
+		c.details = make(map[string]func() any)
+	}
+	c.details[name] = detail
+}
+
+// Shutdown fails readiness from now on, so that no new traffic is routed to the service
+func (c *Checker) Shutdown() {
+	c.shuttingDown.Store(true)
+}
+
+// Register adds the probe routes to the router
+func (c *Checker) Register(r chi.Router) {
+	r.Get("/healthz", c.healthz)
+	r.Get("/readyz", c.readyz)
+	r.Get("/status", c.status)
+}
+
+// State of a single dependency. Errors are logged rather than published, they may describe the internals.
+type CheckResult struct {
+	Status  string `json:"status"`
+	Latency string `json:"latency"`
+}
+
+// Status is the detailed state of the service
+type Status struct {
+	Status    string                 `json:"status"`
+	Version   string                 `json:"version"`
+	StartedAt time.Time              `json:"started_at"`
+	Uptime    string                 `json:"uptime"`
+	Checks    map[string]CheckResult `json:"checks"`
+	Details   map[string]any         `json:"details,omitempty"`
+}
+
+// Overall and per dependency states
+const (
+	StatusOK           = "ok"
+	StatusFailing      = "failing"
+	StatusShuttingDown = "shutting_down"
+)
+
+// Results of the checks, run again once the cached ones expire.
+// The results are shared and must not be modified.
+func (c *Checker) check(ctx context.Context) map[string]CheckResult {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.results != nil && time.Since(c.checkedAt) < c.cacheTTL {
+		return c.results
+	}
+	// Other probes wait for the results, so they don't depend on the caller staying
+	c.results = c.run(context.WithoutCancel(ctx))
+	c.checkedAt = time.Now()
+	return c.results
+}
+
+// Run every check at once, each bounded by the timeout
+func (c *Checker) run(ctx context.Context) map[string]CheckResult {
+	results := make(map[string]CheckResult, len(c.checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := nc.check(ctx)
+			result := CheckResult{Status: StatusOK, Latency: time.Since(start).String()}
+			if err != nil {
+				result.Status = StatusFailing
+				c.logger.WarnContext(ctx, "dependency check failed", "check", nc.name, "error", err)
+			}
+
+			mu.Lock()
+			results[nc.name] = result
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// The process is alive as long as it answers
+func (c *Checker) healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, StatusOK)
+}
+
+// Ready to serve when every dependency works and no shutdown has begun
+func (c *Checker) readyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if c.shuttingDown.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, StatusShuttingDown)
+		return
+	}
+
+	var failing []string
+	for name, result := range c.check(r.Context()) {
+		if result.Status != StatusOK {
+			failing = append(failing, name+": "+result.Status)
+		}
+	}
+	if len(failing) > 0 {
+		sort.Strings(failing)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, strings.Join(failing, "\n"))
+		return
+	}
+	fmt.Fprintln(w, StatusOK)
+}
+
+// Version, uptime and the state of every dependency, answered with 200 even when failing
+func (c *Checker) status(w http.ResponseWriter, r *http.Request) {
+	status := Status{
+		Status:    StatusOK,
+		Version:   c.version,
+		StartedAt: c.started.UTC(),
+		Uptime:    time.Since(c.started).Round(time.Second).String(),
+		Checks:    c.check(r.Context()),
+	}
+	for _, result := range status.Checks {
+		if result.Status != StatusOK {
+			status.Status = StatusFailing
+		}
+	}
+	if c.shuttingDown.Load() {
+		status.Status = StatusShuttingDown
+	}
+	if len(c.details) > 0 {
+		status.Details = make(map[string]any, len(c.details))
+		for name, detail := range c.details {
+			status.Details[name] = detail()
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
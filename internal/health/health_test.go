@@ -0,0 +1,118 @@
+package health_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/health"
+)
+
+func TestChecker(t *testing.T) {
+	var dbErr error
+	var logs bytes.Buffer
+	checker := health.New("1.2.3", 50*time.Millisecond, health.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	checker.Add("database", func(ctx context.Context) error { return dbErr })
+	checker.Add("user_service", func(ctx context.Context) error {
+		// Hangs until the timeout
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	router := chi.NewRouter()
+	checker.Register(router)
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		return rr
+	}
+
+	if rr := get("/healthz"); rr.Code != http.StatusOK {
+		t.Errorf("healthz: want status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	dbErr = errors.New("disk I/O error")
+	rr := get("/readyz")
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz: want status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, "database: failing") || !strings.Contains(body, "user_service: failing") {
+		t.Errorf("readyz: want failing checks listed, got %q", body)
+	}
+	if !strings.Contains(logs.String(), "disk I/O error") || !strings.Contains(logs.String(), "context deadline exceeded") {
+		t.Errorf("want errors of the checks logged, got %q", logs.String())
+	}
+
+	rr = get("/status")
+	body = rr.Body.String()
+	var status health.Status
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || status.Status != health.StatusFailing || status.Version != "1.2.3" ||
+		status.Checks["database"].Status != health.StatusFailing {
+		t.Errorf("wrong status %d: %+v", rr.Code, status)
+	}
+	// Probes are public, errors may describe the internals
+	if strings.Contains(body, "disk I/O error") {
+		t.Errorf("want errors kept out of the status, got %s", body)
+	}
+
+	// Readiness fails during shutdown even with healthy dependencies
+	checker = health.New("1.2.3", 0)
+	checker.Add("database", func(ctx context.Context) error { return nil })
+	router = chi.NewRouter()
+	checker.Register(router)
+	if rr := get("/readyz"); rr.Code != http.StatusOK {
+		t.Errorf("readyz: want status %d, got %d", http.StatusOK, rr.Code)
+	}
+	checker.Shutdown()
+	if rr := get("/readyz"); rr.Code != http.StatusServiceUnavailable || strings.TrimSpace(rr.Body.String()) != health.StatusShuttingDown {
+		t.Errorf("readyz after shutdown: want %d shutting_down, got %d %q", http.StatusServiceUnavailable, rr.Code, rr.Body.String())
+	}
+	if rr := get("/healthz"); rr.Code != http.StatusOK {
+		t.Errorf("healthz after shutdown: want status %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestChecker_cache(t *testing.T) {
+	var runs atomic.Int32
+	newRouter := func(opts ...health.Option) chi.Router {
+		checker := health.New("1.2.3", 0, opts...)
+		checker.Add("database", func(ctx context.Context) error {
+			runs.Add(1)
+			return nil
+		})
+		router := chi.NewRouter()
+		checker.Register(router)
+		return router
+	}
+	probe := func(router chi.Router, times int) {
+		for range times {
+			for _, path := range []string{"/readyz", "/status"} {
+				router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+			}
+		}
+	}
+
+	probe(newRouter(health.WithCacheTTL(time.Hour)), 5)
+	if got := runs.Load(); got != 1 {
+		t.Errorf("want probes answered from one run of the checks, got %d runs", got)
+	}
+
+	runs.Store(0)
+	probe(newRouter(health.WithCacheTTL(0)), 5)
+	if got := runs.Load(); got != 10 {
+		t.Errorf("want every probe to run the checks without a cache, got %d runs", got)
+	}
+}
@@ -0,0 +1,144 @@
+package library
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AuditAction is the kind of change recorded in the audit log
+type AuditAction string
+
+const (
+	AuditCreate AuditAction = "create"
+	AuditUpdate AuditAction = "update"
+	// Update changing nothing but the stock
+	AuditStock  AuditAction = "stock"
+	AuditDelete AuditAction = "delete"
+)
+
+// AuditEntry records a single change of the catalogue.
+// Entries are chained: every hash covers the entry and the hash of the previous one,
+// so editing or removing an entry breaks the chain from that point on.
+type AuditEntry struct {
+	Seq       int64       `json:"seq"`
+	Time      time.Time   `json:"time"`
+	Actor     string      `json:"actor,omitempty"`
+	Action    AuditAction `json:"action"`
+	BookID    string      `json:"book_id"`
+	Before    *Book       `json:"before,omitempty"`
+	After     *Book       `json:"after,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+	PrevHash  string      `json:"prev_hash"`
+	Hash      string      `json:"hash"`
+}
+
+// AuditFilter selects audit entries, zero fields match everything
+type AuditFilter struct {
+	Actor  string
+	Action AuditAction
+	BookID string
+	// Since is inclusive, Until is exclusive
+	Since time.Time
+	Until time.Time
+	// Entries with a greater sequence number only, for paging
+	AfterSeq int64
+	Limit    int
+}
+
+// AuditVerification is the result of checking the hash chain
+type AuditVerification struct {
+	OK      bool  `json:"ok"`
+	Checked int64 `json:"checked"`
+	// Sequence number of the first entry not matching its hash
+	BrokenAt int64 `json:"broken_at,omitempty"`
+}
+
+// BookChange changes books through the given store and returns the audit entry describing the change.
+// The store sees the books as the change leaves them, so snapshots read through it match what is stored.
+type BookChange func(ctx context.Context, books BookStore) (AuditEntry, error)
+
+// AuditStore keeps the audit log
+type AuditStore interface {
+	// AuditChange applies the change and appends its entry, stamped and linked to the last one,
+	// in one transaction or under the write lock of the store: either both are stored or neither,
+	// and changes are logged in the order they were applied
+	AuditChange(ctx context.Context, change BookChange) (AuditEntry, error)
+	// LoadAudit returns matching entries ordered by sequence number
+	LoadAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+	// IterateAudit calls fn for every entry in order, stopping at the first error
+	IterateAudit(ctx context.Context, fn func(AuditEntry) error) error
+}
+
+// SealAuditEntry links the entry to the previous hash and computes its own hash
+func SealAuditEntry(entry *AuditEntry, prevHash string) error {
+	entry.PrevHash = prevHash
+	hash, err := auditHash(*entry)
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+	return nil
+}
+
+func auditHash(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	entry.Time = entry.Time.UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling audit entry: %v", err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// VerifyAuditChain walks the log checking every hash and link
+func VerifyAuditChain(ctx context.Context, store AuditStore) (AuditVerification, error) {
+	result := AuditVerification{OK: true}
+	prevHash := ""
+
+	err := store.IterateAudit(ctx, func(entry AuditEntry) error {
+		result.Checked++
+		hash, err := auditHash(entry)
+		if err != nil {
+			return err
+		}
+		if entry.PrevHash != prevHash || entry.Hash != hash {
+			result.OK = false
+			result.BrokenAt = entry.Seq
+			return errChainBroken
+		}
+		prevHash = entry.Hash
+		return nil
+	})
+	if err != nil && err != errChainBroken {
+		return result, err
+	}
+	return result, nil
+}
+
+// Stops the walk over the log at the first broken link
+var errChainBroken = errors.New("audit chain broken")
+
+// Action recorded for an update from the stored state before to the stored state after it
+func updateAction(before, after Book) AuditAction {
+	if before.Stock != after.Stock {
+		before.Stock = after.Stock
+		if sameBook(before, after) {
+			return AuditStock
+		}
+	}
+	return AuditUpdate
+}
+
+// Compare the catalogue fields of two books
+func sameBook(a, b Book) bool {
+	return a.ID == b.ID && a.Title == b.Title && a.Author == b.Author && a.Description == b.Description &&
+		a.Stock == b.Stock && a.ISBN == b.ISBN && a.Publisher == b.Publisher && a.Year == b.Year &&
+		a.Visibility == b.Visibility
+}
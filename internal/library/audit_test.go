@@ -0,0 +1,130 @@
+package library_test
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+)
+
+// Audit store handing out a forged entry
+type tamperedAudit struct {
+	library.AuditStore
+	seq int64
+}
+
+func (s tamperedAudit) IterateAudit(ctx context.Context, fn func(library.AuditEntry) error) error {
+	return s.AuditStore.IterateAudit(ctx, func(entry library.AuditEntry) error {
+		if entry.Seq == s.seq {
+			entry.Actor = "someone else"
+		}
+		return fn(entry)
+	})
+}
+
+func TestBookService_audit(t *testing.T) {
+	now := time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)
+	store := memory.NewMemoryBookStore(memory.WithClock(fixedClock{now: now}))
+	service := library.NewBookService(store, library.WithAudit(store))
+
+	ctx := library.WithPrincipal(context.Background(), library.NewPrincipal("42", "token", library.PermManageBooks))
+	ctx = context.WithValue(ctx, middleware.RequestIDKey, "req-1")
+
+	book := library.Book{ID: "1", Title: "Go Programming", Author: "Alan Donovan", Stock: "3"}
+	if _, err := service.CreateBook(ctx, book); err != nil {
+		t.Fatal(err)
+	}
+	book.Stock = "2"
+	if err := service.UpdateBook(ctx, "1", book); err != nil {
+		t.Fatal(err)
+	}
+	book.Title = "The Go Programming Language"
+	if err := service.UpdateBook(ctx, "1", book); err != nil {
+		t.Fatal(err)
+	}
+	// Hiding the book is more than a stock change, leaving the visibility out keeps it
+	book.Stock, book.Visibility = "1", library.VisibilityHidden
+	if err := service.UpdateBook(ctx, "1", book); err != nil {
+		t.Fatal(err)
+	}
+	book.Stock, book.Visibility = "0", ""
+	if err := service.UpdateBook(ctx, "1", book); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.DeleteBook(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := service.GetAudit(ctx, library.AuditFilter{BookID: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantActions := []library.AuditAction{library.AuditCreate, library.AuditStock, library.AuditUpdate, library.AuditUpdate,
+		library.AuditStock, library.AuditDelete}
+	if len(entries) != len(wantActions) {
+		t.Fatalf("want %d entries, got %d", len(wantActions), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Action != wantActions[i] || entry.Actor != "42" || entry.RequestID != "req-1" || !entry.Time.Equal(now) {
+			t.Errorf("wrong entry %d: %+v", i, entry)
+		}
+	}
+	if entries[0].Before != nil || entries[0].After == nil || entries[0].After.Stock != "3" {
+		t.Errorf("wrong snapshots of create: %+v, %+v", entries[0].Before, entries[0].After)
+	}
+	if entries[5].Before == nil || entries[5].Before.Title != "The Go Programming Language" || entries[5].After != nil {
+		t.Errorf("wrong snapshots of delete: %+v, %+v", entries[5].Before, entries[5].After)
+	}
+
+	stock, err := service.GetAudit(ctx, library.AuditFilter{Action: library.AuditStock})
+	if err != nil || len(stock) != 2 {
+		t.Errorf("want two stock changes, got %d (%v)", len(stock), err)
+	}
+
+	result, err := service.VerifyAudit(ctx)
+	if err != nil || !result.OK || result.Checked != 6 {
+		t.Errorf("want intact chain of 6 entries, got %+v (%v)", result, err)
+	}
+
+	result, err = library.VerifyAuditChain(ctx, tamperedAudit{AuditStore: store, seq: 2})
+	if err != nil || result.OK || result.BrokenAt != 2 {
+		t.Errorf("want chain broken at 2, got %+v (%v)", result, err)
+	}
+}
+
+func TestBookService_auditConcurrent(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewMemoryBookStore()
+	service := library.NewBookService(store, library.WithAudit(store))
+
+	if _, err := service.CreateBook(ctx, library.Book{ID: "1", Title: "Go Programming", Stock: "0"}); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 1; i <= 20; i++ {
+		wg.Add(1)
+		go func(stock int) {
+			defer wg.Done()
+			if err := service.UpdateBook(ctx, "1", library.Book{Title: "Go Programming", Stock: strconv.Itoa(stock)}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every change starts from the state the previous one left
+	entries, err := service.GetAudit(ctx, library.AuditFilter{BookID: "1"})
+	if err != nil || len(entries) != 21 {
+		t.Fatalf("want 21 entries, got %d (%v)", len(entries), err)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Before.Stock != entries[i-1].After.Stock {
+			t.Errorf("entry %d starts from stock %s, the previous one left %s", entries[i].Seq, entries[i].Before.Stock, entries[i-1].After.Stock)
+		}
+	}
+}
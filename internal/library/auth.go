@@ -0,0 +1,239 @@
+package library
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Realm reported in WWW-Authenticate challenges
+const authRealm = "book-service"
+
+// Principal is the caller of a request as resolved by the user service
+type Principal struct {
+	UserID      string
+	Token       string
+	Permissions uint
+}
+
+// NewPrincipal creates a principal holding only the permissions whose prerequisites are granted too
+func NewPrincipal(userID, token string, permissions uint) *Principal {
+	return &Principal{UserID: userID, Token: token, Permissions: EffectivePermissions(permissions)}
+}
+
+// HasAll reports whether the principal holds every bit of the mask
+func (p *Principal) HasAll(mask uint) bool {
+	return p != nil && p.Permissions&mask == mask
+}
+
+// HasAny reports whether the principal holds at least one bit of the mask
+func (p *Principal) HasAny(mask uint) bool {
+	return p != nil && p.Permissions&mask != 0
+}
+
+type principalKey struct{}
+
+type systemKey struct{}
+
+// WithSystemAccess marks trusted in-process callers, like command line tools,
+// which see every book regardless of its visibility
+func WithSystemAccess(ctx context.Context) context.Context {
+	return context.WithValue(ctx, systemKey{}, true)
+}
+
+// Visibilities of books the caller may read, nil when there is no restriction
+func visibleFor(ctx context.Context) []Visibility {
+	if system, _ := ctx.Value(systemKey{}).(bool); system {
+		return nil
+	}
+	return VisibleTo(PrincipalFromContext(ctx))
+}
+
+// VisibleTo returns the visibilities of books the principal may read.
+// Hidden books are only shown to those managing the catalogue, staff-only books
+// to anyone working with loans or stock.
+func VisibleTo(p *Principal) []Visibility {
+	switch {
+	case p.HasAny(PermManageBooks):
+		return []Visibility{VisibilityPublic, VisibilityStaff, VisibilityHidden}
+	case p.HasAny(PermLoanBooks | PermQueryTotalStock | PermQueryAvailableStock | PermQueryReservations):
+		return []Visibility{VisibilityPublic, VisibilityStaff}
+	default:
+		return []Visibility{VisibilityPublic}
+	}
+}
+
+// WithPrincipal stores the caller in the context
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFromContext returns the caller stored by Authenticate, nil for anonymous requests
+func PrincipalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// ParseBearerToken extracts the token from an Authorization header value
+// following RFC 6750. An empty header yields an empty token.
+func ParseBearerToken(header string) (string, error) {
+	if header == "" {
+		return "", nil
+	}
+
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", errors.Wrap(oops.ErrMalformedAuthorization, "expected Bearer scheme")
+	}
+
+	token = strings.TrimLeft(token, " ")
+	if !isToken68(token) {
+		return "", errors.Wrap(oops.ErrMalformedAuthorization, "invalid bearer token syntax")
+	}
+	return token, nil
+}
+
+// Check the b64token syntax: 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / "+" / "/" ) *"="
+func isToken68(token string) bool {
+	body := strings.TrimRight(token, "=")
+	if body == "" {
+		return false
+	}
+	for _, r := range body {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("-._~+/", r):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Authenticate resolves the caller from the Authorization header once per request
+// and stores it in the request context. Requests without a token proceed anonymously.
+// An invalid token is rejected at once, while a malformed header or a failed lookup
+// only fails the routes requiring permissions, others proceed anonymously.
+func Authenticate(users UserService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := ParseBearerToken(r.Header.Get("Authorization"))
+			if err != nil {
+				next.ServeHTTP(w, r.WithContext(withAuthFailure(r.Context(), err)))
+				return
+			}
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// Request to 'user' microservice to get permissions
+			principal, err := users.Authenticate(r.Context(), token)
+			switch {
+			case errors.Is(err, oops.ErrInvalidToken):
+				challenge(w, "invalid_token", "The access token is invalid or expired", http.StatusUnauthorized)
+				return
+			case errors.Is(err, oops.ErrUserServiceUnavailable):
+				LoggerFromContext(r.Context()).Warn("user service unavailable", "error", err)
+				next.ServeHTTP(w, r.WithContext(withAuthFailure(r.Context(), err)))
+				return
+			case err != nil:
+				LoggerFromContext(r.Context()).Error("checking permissions failed", "error", err)
+				next.ServeHTTP(w, r.WithContext(withAuthFailure(r.Context(), err)))
+				return
+			}
+
+			ctx := WithPrincipal(r.Context(), principal)
+			ctx = logPrincipal(ctx, principal)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+type authFailureKey struct{}
+
+// Keep the reason the caller couldn't be resolved for the routes requiring permissions
+func withAuthFailure(ctx context.Context, err error) context.Context {
+	return context.WithValue(ctx, authFailureKey{}, err)
+}
+
+// Reply to a request whose caller couldn't be resolved
+func failAuth(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, oops.ErrMalformedAuthorization):
+		challenge(w, "invalid_request", err.Error(), http.StatusBadRequest)
+	case errors.Is(err, oops.ErrUserServiceUnavailable):
+		http.Error(w, fmt.Sprintf("Error checking permission: %v", err), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, fmt.Sprintf("Error checking permission: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// RequirePermissions rejects requests whose caller doesn't hold all of the given permissions
+// together with their prerequisites. It must be used after Authenticate.
+func RequirePermissions(masks ...uint) func(http.Handler) http.Handler {
+	var required uint
+	for _, mask := range masks {
+		required |= mask
+	}
+	required = WithPrerequisites(required)
+
+	return requirePrincipal(func(p *Principal) bool { return p.HasAll(required) })
+}
+
+// RequireAnyPermission rejects requests whose caller holds none of the given permissions.
+// It must be used after Authenticate.
+func RequireAnyPermission(masks ...uint) func(http.Handler) http.Handler {
+	var allowed uint
+	for _, mask := range masks {
+		allowed |= mask
+	}
+
+	return requirePrincipal(func(p *Principal) bool { return p.HasAny(allowed) })
+}
+
+func requirePrincipal(allowed func(*Principal) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal := PrincipalFromContext(r.Context())
+			if err, _ := r.Context().Value(authFailureKey{}).(error); principal == nil && err != nil {
+				failAuth(w, err)
+				return
+			}
+			if principal == nil {
+				// No error code when no credentials were given at all
+				challenge(w, "", "", http.StatusUnauthorized)
+				return
+			}
+
+			if !allowed(principal) {
+				challenge(w, "insufficient_scope", "Insufficient permissions", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Reply with a Bearer challenge as described in RFC 6750, section 3
+func challenge(w http.ResponseWriter, code, description string, status int) {
+	params := []string{fmt.Sprintf("realm=%q", authRealm)}
+	if code != "" {
+		params = append(params, fmt.Sprintf("error=%q", code))
+	}
+	if description != "" {
+		params = append(params, fmt.Sprintf("error_description=%q", description))
+	}
+	w.Header().Set("WWW-Authenticate", "Bearer "+strings.Join(params, ", "))
+
+	message := description
+	if message == "" {
+		message = "Missing token"
+	}
+	http.Error(w, message, status)
+}
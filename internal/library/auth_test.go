@@ -0,0 +1,100 @@
+package library_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/mock"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+)
+
+func TestHandler_accessPolicy(t *testing.T) {
+	service := mock.NewMockService()
+
+	// The caller may only loan books
+	loaner := &mock.MockUserServiceClient{Permissions: library.PermLoanBooks}
+	rejecting := &mock.MockUserServiceClient{Err: oops.ErrInvalidToken}
+	unreachable := &mock.MockUserServiceClient{Err: oops.ErrUserServiceUnavailable}
+
+	tests := []struct {
+		name      string
+		users     library.UserService
+		method    string
+		path      string
+		auth      string
+		want      int
+		challenge string
+	}{
+		{"anonymous read", loaner, http.MethodGet, "/api/v1/books/1", "", http.StatusOK, ""},
+		{"authenticated read", loaner, http.MethodGet, "/api/v1/books/1", "Bearer token", http.StatusOK, ""},
+		{"lowercase scheme", loaner, http.MethodGet, "/api/v1/books/1", "bearer token", http.StatusOK, ""},
+		{"raw token", loaner, http.MethodGet, "/api/v1/books/1", "token", http.StatusOK, ""},
+		{"basic scheme", loaner, http.MethodGet, "/api/v1/books/1", "Basic dXNlcjpwYXNz", http.StatusOK, ""},
+		{"raw token delete", loaner, http.MethodDelete, "/api/v1/books/1", "token", http.StatusBadRequest, `error="invalid_request"`},
+		{"anonymous delete", loaner, http.MethodDelete, "/api/v1/books/1", "", http.StatusUnauthorized, `Bearer realm="book-service"`},
+		{"delete without permission", loaner, http.MethodDelete, "/api/v1/books/1", "Bearer token", http.StatusForbidden, `error="insufficient_scope"`},
+		{"invalid token", rejecting, http.MethodGet, "/api/v1/books/1", "Bearer token", http.StatusUnauthorized, `error="invalid_token"`},
+		{"invalid token delete", rejecting, http.MethodDelete, "/api/v1/books/1", "Bearer token", http.StatusUnauthorized, `error="invalid_token"`},
+		{"user service down", unreachable, http.MethodGet, "/api/v1/books/1", "Bearer token", http.StatusOK, ""},
+		{"user service down delete", unreachable, http.MethodDelete, "/api/v1/books/1", "Bearer token", http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := chi.NewRouter()
+			library.NewHandler(router, service, tt.users).Register()
+
+			req, err := http.NewRequest(tt.method, tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.auth != "" {
+				req.Header.Add("Authorization", tt.auth)
+			}
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("handler returned wrong status code: want %d, got %d", tt.want, rr.Code)
+			}
+			if got := rr.Header().Get("WWW-Authenticate"); !strings.Contains(got, tt.challenge) {
+				t.Errorf("wrong challenge: want %q in %q", tt.challenge, got)
+			}
+		})
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	// Changing the total stock without seeing it is not granted
+	p := library.NewPrincipal("42", "token", library.PermChangeTotalStock|library.PermLoanBooks)
+	if p.Permissions != library.PermLoanBooks {
+		t.Errorf("want only PermLoanBooks to be effective, got %b", p.Permissions)
+	}
+
+	p = library.NewPrincipal("42", "token", library.PermManageUsers|library.PermQueryUsers)
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"all of granted", p.HasAll(library.PermManageUsers | library.PermQueryUsers), true},
+		{"all of partly granted", p.HasAll(library.PermManageUsers | library.PermManageBooks), false},
+		{"any of partly granted", p.HasAny(library.PermManageUsers | library.PermManageBooks), true},
+		{"any of not granted", p.HasAny(library.PermManageBooks | library.PermLoanBooks), false},
+		{"anonymous", (*library.Principal)(nil).HasAny(library.PermLoanBooks), false},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: want %v, got %v", tt.name, tt.want, tt.got)
+		}
+	}
+
+	if got := library.WithPrerequisites(library.PermGrantPermissions); got != library.PermGrantPermissions|library.PermQueryUsers {
+		t.Errorf("wrong prerequisites %b", got)
+	}
+}
@@ -1,6 +1,18 @@
 package library
 
-import "context"
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Separator of several authors in Book.Author. Names are often
+// inverted ("Donovan, Alan"), so a comma can't be used.
+const authorSeparator = "; "
 
 // Book structure represents book entity
 type Book struct {
@@ -9,27 +21,200 @@ type Book struct {
 	Author      string `json:"author"`
 	Description string `json:"description"`
 	Stock       string `json:"stock"`
+	ISBN        string `json:"isbn"`
+	Publisher   string `json:"publisher"`
+	Year        string `json:"year"`
+	// Visibility limits who may read the book, new books are public unless told otherwise
+	Visibility Visibility `json:"visibility,omitempty"`
+	// Timestamps are maintained by the stores, values coming from clients are ignored
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// DeletedAt is set on tombstones left by deleted books, which are only returned with IncludeDeleted
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Visibility is the audience of a book
+type Visibility string
+
+const (
+	// Anyone may read the book
+	VisibilityPublic Visibility = "public"
+	// Only library staff may read the book, e.g. restricted collections
+	VisibilityStaff Visibility = "staff"
+	// Only those managing the catalogue may read the book, e.g. unreleased acquisitions
+	VisibilityHidden Visibility = "hidden"
+)
+
+// Clock tells the current time, stores use it to stamp changes
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the wall clock
+var SystemClock Clock = systemClock{}
+
+// BookFilter narrows down the books returned by a search
+type BookFilter struct {
+	// Criteria is a substring looked up in title, author or description
+	Criteria string
+	// UpdatedSince keeps books changed at or after the given time, unless zero
+	UpdatedSince time.Time
+	// UpdatedBefore keeps books changed strictly before the given time, unless zero
+	UpdatedBefore time.Time
+	// IncludeDeleted adds tombstones of deleted books
+	IncludeDeleted bool
+	// AfterID keeps books with greater IDs, for paging through results ordered by ID
+	AfterID string
+	// Limit caps the number of books, unless zero
+	Limit int
+	// Visibility keeps books with one of the given visibilities, unless empty
+	Visibility []Visibility
+}
+
+// Validate checks that the book can be stored in the catalogue
+func (b *Book) Validate() error {
+	if strings.TrimSpace(b.ID) == "" {
+		return errors.Wrap(oops.ErrInvalidBook, "id is required")
+	}
+	if strings.TrimSpace(b.Title) == "" {
+		return errors.Wrap(oops.ErrInvalidBook, "title is required")
+	}
+	switch b.Visibility {
+	case "", VisibilityPublic, VisibilityStaff, VisibilityHidden:
+	default:
+		return errors.Wrapf(oops.ErrInvalidBook, "visibility %q is not one of public, staff, hidden", b.Visibility)
+	}
+	if b.Stock != "" {
+		if stock, err := strconv.Atoi(b.Stock); err != nil || stock < 0 {
+			return errors.Wrapf(oops.ErrInvalidBook, "stock %q is not a non-negative integer", b.Stock)
+		}
+	}
+	if b.Year != "" {
+		if _, err := strconv.ParseUint(b.Year, 10, 16); err != nil || len(b.Year) > 4 {
+			return errors.Wrapf(oops.ErrInvalidBook, "year %q is not valid", b.Year)
+		}
+	}
+	if b.ISBN != "" && !ValidISBN(b.ISBN) {
+		return errors.Wrapf(oops.ErrInvalidBook, "isbn %q is not valid", b.ISBN)
+	}
+	return nil
+}
+
+// Authors splits the author line into individual names
+func (b *Book) Authors() []string {
+	var authors []string
+	for _, name := range strings.Split(b.Author, strings.TrimSpace(authorSeparator)) {
+		if name = strings.TrimSpace(name); name != "" {
+			authors = append(authors, name)
+		}
+	}
+	return authors
+}
+
+// NormalizeISBN strips hyphens and spaces from ISBN and uppercases the check digit
+func NormalizeISBN(isbn string) string {
+	var sb strings.Builder
+	for _, r := range isbn {
+		switch {
+		case r >= '0' && r <= '9':
+			sb.WriteRune(r)
+		case r == 'x' || r == 'X':
+			sb.WriteRune('X')
+		case r == '-' || r == ' ':
+		default:
+			// Keep unexpected characters so that validation rejects them
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// ValidISBN reports whether isbn is a valid ISBN-10 or ISBN-13 (checksum included)
+func ValidISBN(isbn string) bool {
+	isbn = NormalizeISBN(isbn)
+	switch len(isbn) {
+	case 10:
+		sum := 0
+		for i, r := range isbn {
+			var digit int
+			switch {
+			case r >= '0' && r <= '9':
+				digit = int(r - '0')
+			case r == 'X' && i == 9:
+				digit = 10
+			default:
+				return false
+			}
+			sum += (10 - i) * digit
+		}
+		return sum%11 == 0
+	case 13:
+		sum := 0
+		for i, r := range isbn {
+			if r < '0' || r > '9' {
+				return false
+			}
+			digit := int(r - '0')
+			if i%2 == 1 {
+				digit *= 3
+			}
+			sum += digit
+		}
+		return sum%10 == 0
+	}
+	return false
 }
 
 // Intercommunication with 'user' microservice (permission checks)
 type UserService interface {
-	CheckPermissions(token string, mask uint) (bool, error)
+	// Authenticate resolves the token into its owner and the whole permission mask
+	Authenticate(ctx context.Context, token string) (*Principal, error)
 }
 
 // BookService defines the interface for interacting with books (business logic)
 type BookService interface {
-	GetBooks(ctx context.Context, criteria string) ([]Book, error)
+	GetBooks(ctx context.Context, filter BookFilter) ([]Book, error)
+	// StreamBooks calls fn for every matching book ordered by ID, stopping at the first error
+	StreamBooks(ctx context.Context, filter BookFilter, fn func(Book) error) error
 	GetBookByID(ctx context.Context, id string) (*Book, error)
+	GetBookByISBN(ctx context.Context, isbn string) (*Book, error)
 	CreateBook(ctx context.Context, book Book) (string, error)
 	UpdateBook(ctx context.Context, id string, book Book) error
 	DeleteBook(ctx context.Context, id string) error
+	// GetAudit returns the recorded changes of the catalogue
+	GetAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+	// VerifyAudit checks that the audit log was not tampered with
+	VerifyAudit(ctx context.Context) (AuditVerification, error)
 }
 
 // BookStore defines the inteface for database interactions related to books
 type BookStore interface {
-	LoadBooks(ctx context.Context, criteria string) ([]Book, error)
-	LoadBookByID(ctx context.Context, id string) (*Book, error)
+	LoadBooks(ctx context.Context, filter BookFilter) ([]Book, error)
+	// IterateBooks calls fn for every matching book ordered by ID without buffering the result set.
+	// Stores don't hold locks or transactions while fn runs, so a slow fn doesn't block writers.
+	IterateBooks(ctx context.Context, filter BookFilter, fn func(Book) error) error
+	// LoadBookByID and LoadBookByISBN only find books with one of the given visibilities, if any are given
+	LoadBookByID(ctx context.Context, id string, visibility ...Visibility) (*Book, error)
+	LoadBookByISBN(ctx context.Context, isbn string, visibility ...Visibility) (*Book, error)
 	SaveBook(ctx context.Context, book Book) (string, error)
 	UpdateBook(ctx context.Context, id string, book Book) error
 	DeleteBook(ctx context.Context, id string) error
 }
+
+// CatalogueCount is the size of the catalogue, deleted books excluded
+type CatalogueCount struct {
+	Books map[Visibility]int
+	// Copies of all books, an empty stock counts as none
+	Stock int
+}
+
+// BookCounter counts the catalogue within the store, without reading every book out of it
+type BookCounter interface {
+	CountBooks(ctx context.Context) (CatalogueCount, error)
+}
@@ -0,0 +1,94 @@
+package library
+
+import (
+	"sync"
+	"time"
+)
+
+// Defaults of the circuit breaker
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 10 * time.Second
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// Circuit breaker around calls to a remote service.
+// After threshold consecutive failures the circuit opens and calls fail fast.
+// Once the cooldown passes a single probe call is let through: success closes
+// the circuit, failure opens it again.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	clock     Clock
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration, clock Clock) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, clock: clock}
+}
+
+// Allow reports whether a call may be made now.
+// When it returns false, retryAfter is the time left until the next probe.
+func (b *breaker) Allow() (ok bool, retryAfter time.Duration) {
+	if b == nil || b.threshold <= 0 {
+		return true, 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerClosed {
+		return true, 0
+	}
+
+	// Only one probe per cooldown goes through, a probe whose outcome
+	// was never recorded is replaced by a new one after the cooldown
+	now := b.clock.Now()
+	elapsed := now.Sub(b.openedAt)
+	if elapsed < b.cooldown {
+		return false, b.cooldown - elapsed
+	}
+	b.state = breakerHalfOpen
+	b.openedAt = now
+	return true, 0
+}
+
+// Success records a call which reached the remote service
+func (b *breaker) Success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = breakerClosed
+	b.failures = 0
+}
+
+// Failure records a call which didn't reach the remote service
+func (b *breaker) Failure() {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.state = breakerOpen
+		b.openedAt = b.clock.Now()
+	}
+}
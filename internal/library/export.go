@@ -0,0 +1,128 @@
+package library
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/marc"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// ExportFormat is the encoding of a catalogue export
+type ExportFormat string
+
+const (
+	ExportCSV     ExportFormat = "csv"
+	ExportNDJSON  ExportFormat = "ndjson"
+	ExportMARCXML ExportFormat = "marcxml"
+)
+
+// ParseExportFormat converts a user supplied format name into ExportFormat
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch ExportFormat(strings.ToLower(name)) {
+	case "", ExportCSV:
+		return ExportCSV, nil
+	case ExportNDJSON, "jsonl":
+		return ExportNDJSON, nil
+	case ExportMARCXML:
+		return ExportMARCXML, nil
+	}
+	return "", errors.Wrapf(oops.ErrUnknownFormat, "%q", name)
+}
+
+// ContentType of the exported document
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case ExportNDJSON:
+		return "application/x-ndjson"
+	case ExportMARCXML:
+		return "application/marcxml+xml"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// Extension of a file holding the exported document
+func (f ExportFormat) Extension() string {
+	if f == ExportMARCXML {
+		return "xml"
+	}
+	return string(f)
+}
+
+// BookWriter encodes books one at a time. Close must be called
+// to finish the document, it doesn't close the underlying writer.
+type BookWriter interface {
+	Write(book Book) error
+	Close() error
+}
+
+// NewBookWriter creates a writer encoding books in the given format
+func NewBookWriter(w io.Writer, format ExportFormat) (BookWriter, error) {
+	switch format {
+	case ExportCSV:
+		return &csvBookWriter{writer: csv.NewWriter(w)}, nil
+	case ExportNDJSON:
+		return &ndjsonBookWriter{encoder: json.NewEncoder(w)}, nil
+	case ExportMARCXML:
+		return &marcBookWriter{writer: marc.NewXMLWriter(w)}, nil
+	}
+	return nil, errors.Wrapf(oops.ErrUnknownFormat, "%q", format)
+}
+
+// Column order of CSV exports, matches the names accepted by the importer
+var exportColumns = []string{"id", "title", "author", "description", "stock", "isbn", "publisher", "year"}
+
+type csvBookWriter struct {
+	writer        *csv.Writer
+	headerWritten bool
+}
+
+func (w *csvBookWriter) writeHeader() error {
+	if w.headerWritten {
+		return nil
+	}
+	w.headerWritten = true
+	return w.writer.Write(exportColumns)
+}
+
+func (w *csvBookWriter) Write(book Book) error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	return w.writer.Write([]string{book.ID, book.Title, book.Author, book.Description, book.Stock, book.ISBN, book.Publisher, book.Year})
+}
+
+func (w *csvBookWriter) Close() error {
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type ndjsonBookWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *ndjsonBookWriter) Write(book Book) error {
+	return w.encoder.Encode(book)
+}
+
+func (w *ndjsonBookWriter) Close() error {
+	return nil
+}
+
+type marcBookWriter struct {
+	writer *marc.XMLWriter
+}
+
+func (w *marcBookWriter) Write(book Book) error {
+	return w.writer.WriteRecord(BookToMARC(book))
+}
+
+func (w *marcBookWriter) Close() error {
+	return w.writer.Close()
+}
@@ -0,0 +1,13 @@
+package library
+
+// CachedPrincipals returns the principals held by the cache, most recently used first
+func (c *CachedUserService) CachedPrincipals() []Principal {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var principals []Principal
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		principals = append(principals, elem.Value.(cacheEntry).principal)
+	}
+	return principals
+}
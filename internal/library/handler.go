@@ -3,43 +3,117 @@ package library
 import (
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
 )
 
 type Handler struct {
 	router  *chi.Mux
 	service BookService
 	userSVC UserService
+
+	ipLimit    *RateLimiter
+	readLimit  *RateLimiter
+	writeLimit *RateLimiter
+
+	maxBodyBytes   int64
+	maxImportBytes int64
+}
+
+// HandlerOption configures Handler
+type HandlerOption func(*Handler)
+
+// WithRateLimits throttles clients of read and write routes separately, nil disables a limit
+func WithRateLimits(read, write *RateLimiter) HandlerOption {
+	return func(h *Handler) {
+		h.readLimit = read
+		h.writeLimit = write
+	}
+}
+
+// WithIPRateLimit throttles every address before the caller is resolved, so that the user service
+// isn't flooded with lookups of made up tokens. The limiter must tell clients apart by IP address.
+func WithIPRateLimit(limit *RateLimiter) HandlerOption {
+	return func(h *Handler) { h.ipLimit = limit }
+}
+
+// WithMaxBodyBytes rejects JSON bodies larger than n bytes with 413, zero means no limit
+func WithMaxBodyBytes(n int64) HandlerOption {
+	return func(h *Handler) { h.maxBodyBytes = n }
+}
+
+// WithMaxImportBytes rejects imported files larger than n bytes with 413, zero means no limit.
+// The rows of a file are read before any is imported, so the limit bounds the memory of an import.
+func WithMaxImportBytes(n int64) HandlerOption {
+	return func(h *Handler) { h.maxImportBytes = n }
 }
 
-func NewHandler(router *chi.Mux, service BookService, userSVC UserService) *Handler {
-	return &Handler{
+func NewHandler(router *chi.Mux, service BookService, userSVC UserService, opts ...HandlerOption) *Handler {
+	h := &Handler{
 		router:  router,
 		service: service,
 		userSVC: userSVC,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
-// Register routes for the Handler
+// Register routes for the Handler together with their access policy
 func (h *Handler) Register() {
 	h.router.Group(func(r chi.Router) {
-		r.Get("/api/v1/books", h.getBooks)
-		r.Get("/api/v1/books/{id}", h.getBookByID)
-		r.Post("/api/v1/books/new", h.createBook)
-		r.Post("/api/v1/books/{id}", h.updateBook)
-		r.Delete("/api/v1/books/{id}", h.deleteBook)
+		useLimit(r, h.ipLimit)
+		r.Use(Authenticate(h.userSVC))
+
+		// Anyone may browse the catalogue
+		r.Group(func(r chi.Router) {
+			useLimit(r, h.readLimit)
+
+			r.Get("/api/v1/books", h.getBooks)
+			r.Get("/api/v1/books/export", h.exportBooks)
+			r.Get("/api/v1/books/{id}", h.getBookByID)
+		})
+
+		// Changes require the right to manage books
+		r.Group(func(r chi.Router) {
+			useLimit(r, h.writeLimit)
+			r.Use(RequirePermissions(PermManageBooks))
+
+			r.Post("/api/v1/books/new", h.createBook)
+			r.Post("/api/v1/books/import", h.importBooks)
+			r.Post("/api/v1/books/{id}", h.updateBook)
+			r.Delete("/api/v1/books/{id}", h.deleteBook)
+
+			r.Get("/api/v1/audit", h.getAudit)
+			r.Get("/api/v1/audit/verify", h.verifyAudit)
+		})
 	})
 }
 
+func useLimit(r chi.Router, limit *RateLimiter) {
+	if limit != nil {
+		r.Use(limit.Middleware)
+	}
+}
+
 // Handles GET request to fetch all books
 func (h *Handler) getBooks(w http.ResponseWriter, r *http.Request) {
-	criteria := r.URL.Query().Get("criteria")
+	filter, err := parseBookFilter(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
 	ctx := r.Context()
 
 	// Get list of books from the service
-	books, err := h.service.GetBooks(ctx, criteria)
+	books, err := h.service.GetBooks(ctx, filter)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get books: %v", err), http.StatusInternalServerError)
 		return
@@ -53,6 +127,60 @@ func (h *Handler) getBooks(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Handles GET request to stream the whole catalogue (or its filtered part) as a file
+func (h *Handler) exportBooks(w http.ResponseWriter, r *http.Request) {
+	format, err := ParseExportFormat(r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid format: %v", err), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseBookFilter(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+
+	body := &startedWriter{ResponseWriter: w}
+	writer, err := NewBookWriter(body, format)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to export books: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": "books." + format.Extension(),
+	}))
+
+	// Books are written as they come from the store. An error before the first one
+	// is out still gets its status, afterwards it can only cut the stream.
+	err = h.service.StreamBooks(ctx, filter, writer.Write)
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		return
+	}
+	if body.started {
+		LoggerFromContext(ctx).Error("export failed after the response started", "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	w.Header().Del("Content-Disposition")
+	http.Error(w, fmt.Sprintf("Failed to export books: %v", err), errorStatus(err))
+}
+
+// Response writer remembering whether the body has started, after which the status can't be changed
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedWriter) Write(p []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(p)
+}
+
 // Handles GET request to fetch a single book by ID
 func (h *Handler) getBookByID(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
@@ -61,7 +189,7 @@ func (h *Handler) getBookByID(w http.ResponseWriter, r *http.Request) {
 	// Get the book by ID from the service
 	book, err := h.service.GetBookByID(ctx, id)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get book by ID: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to get book by ID: %v", err), errorStatus(err))
 		return
 	}
 	if book == nil {
@@ -79,28 +207,8 @@ func (h *Handler) getBookByID(w http.ResponseWriter, r *http.Request) {
 
 // Handles POST requests to create a new book
 func (h *Handler) createBook(w http.ResponseWriter, r *http.Request) {
-	// First, let's get authorization token
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
-		return
-	}
-
-	// Request to 'user' microservice to get permissions
-	manage, err := h.userSVC.CheckPermissions(token, PermManageBooks)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error checking permission: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	if !manage {
-		http.Error(w, "Insufficient permissions", http.StatusForbidden)
-		return
-	}
-
 	var book Book
-	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+	if !h.decodeBody(w, r, &book) {
 		return
 	}
 	ctx := r.Context()
@@ -108,7 +216,7 @@ func (h *Handler) createBook(w http.ResponseWriter, r *http.Request) {
 	// Create the book via the service
 	id, err := h.service.CreateBook(ctx, book)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to create book: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to create book: %v", err), errorStatus(err))
 		return
 	}
 
@@ -121,38 +229,36 @@ func (h *Handler) createBook(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Handles PUT request to update a book by ID
-func (h *Handler) updateBook(w http.ResponseWriter, r *http.Request) {
-	// First, let's get authorization token
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
-		return
+// Decode the JSON body into v, answering the client itself when the body is too large or malformed
+func (h *Handler) decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	body := r.Body
+	if h.maxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes)
 	}
-
-	// Request to 'user' microservice to get permissions
-	manage, err := h.userSVC.CheckPermissions(token, PermManageBooks)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error checking permission: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	if !manage {
-		http.Error(w, "Insufficient permissions", http.StatusForbidden)
-		return
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return false
+		}
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return false
 	}
+	return true
+}
 
+// Handles PUT request to update a book by ID
+func (h *Handler) updateBook(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	var book Book
-	if err := json.NewDecoder(r.Body).Decode(&book); err != nil {
-		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+	if !h.decodeBody(w, r, &book) {
 		return
 	}
 	ctx := r.Context()
 
 	// Update the book via the service
 	if err := h.service.UpdateBook(ctx, id, book); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to update book: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to update book: %v", err), errorStatus(err))
 		return
 	}
 
@@ -162,34 +268,189 @@ func (h *Handler) updateBook(w http.ResponseWriter, r *http.Request) {
 
 // Handles DELETE request to delete a book by ID
 func (h *Handler) deleteBook(w http.ResponseWriter, r *http.Request) {
-	// First, let's get authorization token
-	token := r.Header.Get("Authorization")
-	if token == "" {
-		http.Error(w, "Missing token", http.StatusUnauthorized)
+	id := chi.URLParam(r, "id")
+	ctx := r.Context()
+
+	// Delete the book via the service
+	if err := h.service.DeleteBook(ctx, id); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to delete book: %v", err), http.StatusInternalServerError)
 		return
 	}
 
-	// Request to 'user' microservice to get permissions
-	manage, err := h.userSVC.CheckPermissions(token, PermManageBooks)
+	// Return a success response
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handles POST request to import books in bulk from CSV or NDJSON body
+func (h *Handler) importBooks(w http.ResponseWriter, r *http.Request) {
+	// Format is taken from the query, falling back to the body content type
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format, _, _ = mime.ParseMediaType(r.Header.Get("Content-Type"))
+	}
+
+	var opts ImportOptions
+	var err error
+	if opts.Format, err = ParseImportFormat(format); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid format: %v", err), http.StatusBadRequest)
+		return
+	}
+	if opts.Mode, err = ParseImportMode(query.Get("mode")); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid mode: %v", err), http.StatusBadRequest)
+		return
+	}
+	if dryRun := query.Get("dry_run"); dryRun != "" {
+		if opts.DryRun, err = strconv.ParseBool(dryRun); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid dry_run: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	ctx := r.Context()
+
+	body := r.Body
+	if h.maxImportBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.maxImportBytes)
+	}
+
+	// Import the books via the service
+	report, err := NewImporter(h.service).Import(ctx, body, opts)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error checking permission: %v", err), http.StatusInternalServerError)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to import books: %v", err), http.StatusBadRequest)
 		return
 	}
 
-	if !manage {
-		http.Error(w, "Insufficient permissions", http.StatusForbidden)
+	// Return the import report
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode report: %v", err), http.StatusInternalServerError)
 		return
 	}
+}
 
-	id := chi.URLParam(r, "id")
+// Handles GET request to fetch the audit log of catalogue changes
+func (h *Handler) getAudit(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid filter: %v", err), http.StatusBadRequest)
+		return
+	}
 	ctx := r.Context()
 
-	// Delete the book via the service
-	if err := h.service.DeleteBook(ctx, id); err != nil {
-		http.Error(w, fmt.Sprintf("Failed to delete book: %v", err), http.StatusInternalServerError)
+	entries, err := h.service.GetAudit(ctx, filter)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get audit log: %v", err), errorStatus(err))
 		return
 	}
 
-	// Return a success response
-	w.WriteHeader(http.StatusNoContent)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode audit log: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Handles GET request to check the hash chain of the audit log
+func (h *Handler) verifyAudit(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	result, err := h.service.VerifyAudit(ctx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to verify audit log: %v", err), errorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode result: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Page size of the audit log
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// Build the audit filter from query parameters
+func parseAuditFilter(r *http.Request) (AuditFilter, error) {
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Actor:  query.Get("actor"),
+		Action: AuditAction(query.Get("action")),
+		BookID: query.Get("book_id"),
+		Limit:  defaultAuditLimit,
+	}
+
+	switch filter.Action {
+	case "", AuditCreate, AuditUpdate, AuditStock, AuditDelete:
+	default:
+		return filter, errors.Errorf("unknown action %q", filter.Action)
+	}
+
+	for name, field := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return filter, errors.Wrapf(err, "%s must be an RFC 3339 timestamp", name)
+			}
+			*field = t
+		}
+	}
+
+	if after := query.Get("after"); after != "" {
+		seq, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || seq < 0 {
+			return filter, errors.Errorf("after must be a sequence number")
+		}
+		filter.AfterSeq = seq
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 || n > maxAuditLimit {
+			return filter, errors.Errorf("limit must be between 1 and %d", maxAuditLimit)
+		}
+		filter.Limit = n
+	}
+
+	return filter, nil
+}
+
+// Build the search filter from query parameters
+func parseBookFilter(r *http.Request) (BookFilter, error) {
+	query := r.URL.Query()
+	filter := BookFilter{
+		Criteria: query.Get("criteria"),
+	}
+
+	if since := query.Get("updated_since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return filter, errors.Wrap(err, "updated_since must be an RFC 3339 timestamp")
+		}
+		filter.UpdatedSince = t
+	}
+
+	return filter, nil
+}
+
+// Map service errors onto HTTP status codes
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, oops.ErrInvalidBook):
+		return http.StatusBadRequest
+	case errors.Is(err, oops.ErrUnexistedBook):
+		return http.StatusNotFound
+	case errors.Is(err, oops.ErrDuplicateID):
+		return http.StatusConflict
+	case errors.Is(err, oops.ErrAuditDisabled):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
 }
@@ -1,7 +1,11 @@
 package library_test
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -137,7 +141,7 @@ func TestHandler_createBook(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	req.Header.Add("Authorization", "No matter")
+	req.Header.Add("Authorization", "Bearer no-matter")
 
 	// Create ResponseRecorder for testing
 	rr := httptest.NewRecorder()
@@ -166,6 +170,52 @@ func TestHandler_createBook(t *testing.T) {
 	})
 }
 
+func TestHandler_maxBodyBytes(t *testing.T) {
+	router := chi.NewRouter()
+	h := library.NewHandler(router, mock.NewMockService(), mock.NewMockUserServiceClient(), library.WithMaxBodyBytes(64))
+	h.Register()
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/books/new", strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer no-matter")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post(`{"title": "New Book"}`); rr.Code != http.StatusCreated {
+		t.Errorf("small body: want status %d, got %d", http.StatusCreated, rr.Code)
+	}
+	large := `{"title": "New Book", "description": "` + strings.Repeat("long ", 20) + `"}`
+	if rr := post(large); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body: want status %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+}
+
+func TestHandler_maxImportBytes(t *testing.T) {
+	router := chi.NewRouter()
+	h := library.NewHandler(router, mock.NewMockService(), mock.NewMockUserServiceClient(), library.WithMaxImportBytes(64))
+	h.Register()
+
+	post := func(format, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/books/import?dry_run=true&format="+format, strings.NewReader(body))
+		req.Header.Add("Authorization", "Bearer no-matter")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post("csv", "id,title\n"); rr.Code != http.StatusOK {
+		t.Errorf("small file: want status %d, got %d %s", http.StatusOK, rr.Code, rr.Body)
+	}
+	if rr := post("csv", "id,title\n"+strings.Repeat("1,Go Programming\n", 10)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large CSV file: want status %d, got %d %s", http.StatusRequestEntityTooLarge, rr.Code, rr.Body)
+	}
+	if rr := post("ndjson", strings.Repeat(`{"title": "Go Programming"}`+"\n", 10)); rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large NDJSON file: want status %d, got %d %s", http.StatusRequestEntityTooLarge, rr.Code, rr.Body)
+	}
+}
+
 func TestHandler_updateBook(t *testing.T) {
 	service := mock.NewMockService()
 	router := chi.NewRouter()
@@ -182,7 +232,7 @@ func TestHandler_updateBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	req.Header.Add("Authorization", "No matter what")
+	req.Header.Add("Authorization", "Bearer no-matter-what")
 
 	// Create ResponseRecorder for testing
 	rr := httptest.NewRecorder()
@@ -211,7 +261,7 @@ func TestHandler_deleteBook(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	req.Header.Add("Authorization", "Now matter what")
+	req.Header.Add("Authorization", "Bearer no-matter-what")
 
 	// Create ResponseRecorder for testing
 	rr := httptest.NewRecorder()
@@ -224,3 +274,110 @@ func TestHandler_deleteBook(t *testing.T) {
 		}
 	})
 }
+
+func TestHandler_exportBooks(t *testing.T) {
+	service := mock.NewMockService()
+	router := chi.NewRouter()
+
+	usr := mock.NewMockUserServiceClient()
+
+	// Handler creation
+	h := library.NewHandler(router, service, usr)
+	h.Register()
+
+	// Create GET request to export books as CSV
+	req, err := http.NewRequest(http.MethodGet, "/api/v1/books/export?format=csv", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Create ResponseRecorder for testing
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	// Check response status
+	t.Run("status", func(t *testing.T) {
+		if rr.Code != http.StatusOK {
+			t.Errorf("handler returned wrong status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	// Check the headers
+	t.Run("headers", func(t *testing.T) {
+		want := `attachment; filename=books.csv`
+		if got := rr.Header().Get("Content-Disposition"); got != want {
+			t.Errorf("wrong Content-Disposition: want %q, got %q", want, got)
+		}
+	})
+
+	// Check the answer
+	t.Run("body", func(t *testing.T) {
+		want := "id,title,author,description,stock,isbn,publisher,year\n" +
+			"1,Book One,Author One,Description One,100,,,\n" +
+			"2,Book Two,Author Two,Description Two,52,,,\n"
+
+		if diff := cmp.Diff(want, rr.Body.String()); diff != "" {
+			t.Errorf("GET /api/v1/books/export mismatch: (-want +got)\n%s", diff)
+		}
+	})
+}
+
+// Service failing to read the catalogue
+type failingStreamService struct {
+	*mock.Mock
+	// Streamed before the failure
+	books []library.Book
+}
+
+func (s failingStreamService) StreamBooks(_ context.Context, _ library.BookFilter, fn func(library.Book) error) error {
+	for _, book := range s.books {
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+	return errors.New("database is locked")
+}
+
+func TestHandler_exportBooks_failure(t *testing.T) {
+	router := chi.NewRouter()
+	h := library.NewHandler(router, failingStreamService{Mock: mock.NewMockService()}, mock.NewMockUserServiceClient())
+	h.Register()
+
+	for _, format := range []string{"csv", "ndjson", "marcxml"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/v1/books/export?format="+format, nil))
+
+		if rr.Code != http.StatusInternalServerError {
+			t.Errorf("%s: want status %d before anything is streamed, got %d", format, http.StatusInternalServerError, rr.Code)
+		}
+		if got := rr.Header().Get("Content-Disposition"); got != "" {
+			t.Errorf("%s: want no attachment for an error, got %q", format, got)
+		}
+	}
+}
+
+// A failure after the first book is out cuts the response, and is still logged
+func TestHandler_exportBooks_aborted(t *testing.T) {
+	var buf bytes.Buffer
+	router := chi.NewRouter()
+	router.Use(library.AccessLog(slog.New(slog.NewJSONHandler(&buf, nil))))
+	service := failingStreamService{Mock: mock.NewMockService(), books: []library.Book{{ID: "1", Title: "Go Programming"}}}
+	library.NewHandler(router, service, mock.NewMockUserServiceClient()).Register()
+
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("want the response aborted, got %v", p)
+			}
+		}()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/v1/books/export?format=ndjson", nil))
+	}()
+
+	logs := buf.String()
+	if !strings.Contains(logs, `"msg":"export failed after the response started"`) || !strings.Contains(logs, "database is locked") {
+		t.Errorf("want the failure logged, got %s", logs)
+	}
+	if !strings.Contains(logs, `"msg":"request"`) || !strings.Contains(logs, `"aborted":true`) {
+		t.Errorf("want an access record of the aborted request, got %s", logs)
+	}
+}
@@ -0,0 +1,350 @@
+package library
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/marc"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// ImportFormat is the encoding of a bulk import file
+type ImportFormat string
+
+const (
+	// ImportCSV is a comma separated file with a header row naming Book fields
+	ImportCSV ImportFormat = "csv"
+	// ImportNDJSON is a file with one JSON encoded Book per line
+	ImportNDJSON ImportFormat = "ndjson"
+	// ImportMARC is a binary MARC 21 (ISO 2709) file
+	ImportMARC ImportFormat = "marc"
+)
+
+// ImportMode decides what happens to rows describing books that already exist
+type ImportMode string
+
+const (
+	// ImportCreate only creates books, existing ones are reported as errors
+	ImportCreate ImportMode = "create"
+	// ImportUpsertID updates the book with the same ID or creates a new one
+	ImportUpsertID ImportMode = "upsert-id"
+	// ImportUpsertISBN updates the book with the same ISBN or creates a new one
+	ImportUpsertISBN ImportMode = "upsert-isbn"
+)
+
+// ImportOptions control a single bulk import
+type ImportOptions struct {
+	Format ImportFormat
+	Mode   ImportMode
+	// DryRun validates every row without writing anything
+	DryRun bool
+	// Columns maps CSV header names onto Book fields (by their JSON names).
+	// Headers which are not listed are matched against field names directly.
+	Columns map[string]string
+}
+
+// ImportRowError describes a row which could not be imported.
+// Text formats report the line a row starts at, MARC files report the record number.
+type ImportRowError struct {
+	Line   int    `json:"line,omitempty"`
+	Record int    `json:"record,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Error  string `json:"error"`
+}
+
+// ImportReport summarizes the outcome of a bulk import
+type ImportReport struct {
+	DryRun  bool             `json:"dry_run"`
+	Total   int              `json:"total"`
+	Created int              `json:"created"`
+	Updated int              `json:"updated"`
+	Failed  int              `json:"failed"`
+	Errors  []ImportRowError `json:"errors"`
+}
+
+// ParseImportFormat converts a user supplied format name into ImportFormat
+func ParseImportFormat(name string) (ImportFormat, error) {
+	switch strings.ToLower(name) {
+	case "csv", "text/csv":
+		return ImportCSV, nil
+	case "ndjson", "jsonl", "application/x-ndjson", "application/jsonl":
+		return ImportNDJSON, nil
+	case "marc", "mrc", "application/marc":
+		return ImportMARC, nil
+	}
+	return "", errors.Wrapf(oops.ErrUnknownFormat, "%q", name)
+}
+
+// ParseImportMode converts a user supplied mode name into ImportMode
+func ParseImportMode(name string) (ImportMode, error) {
+	switch ImportMode(name) {
+	case "":
+		return ImportCreate, nil
+	case ImportCreate, ImportUpsertID, ImportUpsertISBN:
+		return ImportMode(name), nil
+	}
+	return "", errors.Wrapf(oops.ErrUnknownMode, "%q", name)
+}
+
+// Importer loads books in bulk through BookService,
+// so imported rows pass the same validation as single books
+type Importer struct {
+	service BookService
+}
+
+func NewImporter(service BookService) *Importer {
+	return &Importer{service: service}
+}
+
+// A decoded row together with its position in the input
+type importRow struct {
+	line   int
+	record int
+	book   Book
+	err    error
+}
+
+// Import reads books from r and writes them through the service.
+// Row-level problems are collected in the report, the returned error is
+// reserved for problems with the input as a whole.
+func (im *Importer) Import(ctx context.Context, r io.Reader, opts ImportOptions) (*ImportReport, error) {
+	mode, err := ParseImportMode(string(opts.Mode))
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []importRow
+	switch opts.Format {
+	case ImportCSV:
+		rows, err = readCSVRows(r, opts.Columns)
+	case ImportNDJSON:
+		rows, err = readNDJSONRows(r)
+	case ImportMARC:
+		rows, err = readMARCRows(r)
+	default:
+		err = errors.Wrapf(oops.ErrUnknownFormat, "%q", opts.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: opts.DryRun, Total: len(rows), Errors: []ImportRowError{}}
+	seen := make(map[string]int)
+	for _, row := range rows {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		created, err := im.importRow(ctx, row, mode, opts.DryRun, seen)
+		if err != nil {
+			report.Failed++
+			report.Errors = append(report.Errors, ImportRowError{Line: row.line, Record: row.record, ID: row.book.ID, Error: err.Error()})
+			continue
+		}
+		if created {
+			report.Created++
+		} else {
+			report.Updated++
+		}
+	}
+
+	return report, nil
+}
+
+// Validate and write a single row, reporting whether a new book was created
+func (im *Importer) importRow(ctx context.Context, row importRow, mode ImportMode, dryRun bool, seen map[string]int) (bool, error) {
+	if row.err != nil {
+		return false, row.err
+	}
+
+	book := row.book
+	book.ISBN = NormalizeISBN(book.ISBN)
+
+	// The same key twice in one file is almost certainly a mistake
+	key := book.ID
+	if mode == ImportUpsertISBN {
+		key = book.ISBN
+	}
+	if key != "" {
+		if line, ok := seen[key]; ok {
+			return false, fmt.Errorf("duplicate of line %d", line)
+		}
+		seen[key] = row.line
+	}
+
+	existing, err := im.lookup(ctx, book, mode)
+	if err != nil {
+		return false, err
+	}
+
+	if existing == nil {
+		if dryRun {
+			return true, book.Validate()
+		}
+		_, err := im.service.CreateBook(ctx, book)
+		return true, err
+	}
+
+	if mode == ImportCreate {
+		return false, oops.ErrDuplicateID
+	}
+
+	// Upserting by ISBN keeps the ID of the stored book
+	book.ID = existing.ID
+	if dryRun {
+		return false, book.Validate()
+	}
+	return false, im.service.UpdateBook(ctx, existing.ID, book)
+}
+
+// Find the stored book the row refers to, nil if there is none
+func (im *Importer) lookup(ctx context.Context, book Book, mode ImportMode) (*Book, error) {
+	var (
+		existing *Book
+		err      error
+	)
+	switch {
+	case mode == ImportUpsertISBN:
+		if book.ISBN == "" {
+			return nil, errors.Wrap(oops.ErrInvalidBook, "isbn is required to upsert by isbn")
+		}
+		existing, err = im.service.GetBookByISBN(ctx, book.ISBN)
+	case book.ID != "":
+		existing, err = im.service.GetBookByID(ctx, book.ID)
+	default:
+		return nil, nil
+	}
+
+	if errors.Is(err, oops.ErrUnexistedBook) {
+		return nil, nil
+	}
+	return existing, err
+}
+
+// Fields of Book addressable from an import header
+var importFields = map[string]func(*Book) *string{
+	"id":          func(b *Book) *string { return &b.ID },
+	"title":       func(b *Book) *string { return &b.Title },
+	"author":      func(b *Book) *string { return &b.Author },
+	"description": func(b *Book) *string { return &b.Description },
+	"stock":       func(b *Book) *string { return &b.Stock },
+	"isbn":        func(b *Book) *string { return &b.ISBN },
+	"publisher":   func(b *Book) *string { return &b.Publisher },
+	"year":        func(b *Book) *string { return &b.Year },
+	"visibility":  func(b *Book) *string { return (*string)(&b.Visibility) },
+}
+
+func readCSVRows(r io.Reader, columns map[string]string) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, oops.ErrImportHeader.Error())
+	}
+
+	// Resolve every column to a Book field up front
+	fields := make([]func(*Book) *string, len(header))
+	var unknown []string
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if mapped, ok := columns[name]; ok {
+			name = mapped
+		}
+		field, ok := importFields[strings.ToLower(name)]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+		fields[i] = field
+	}
+	if len(unknown) > 0 {
+		return nil, errors.Wrapf(oops.ErrImportHeader, "unknown columns %s", strings.Join(unknown, ", "))
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{line: parseErr.StartLine, err: parseErr.Err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		var book Book
+		for i, value := range record {
+			*fields[i](&book) = strings.TrimSpace(value)
+		}
+		rows = append(rows, importRow{line: line, book: book})
+	}
+
+	return rows, nil
+}
+
+func readNDJSONRows(r io.Reader) ([]importRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	var rows []importRow
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var book Book
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&book)
+		rows = append(rows, importRow{line: line, book: book, err: err})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+func readMARCRows(r io.Reader) ([]importRow, error) {
+	reader := marc.NewReader(r)
+
+	var rows []importRow
+	for number := 1; ; number++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, marc.ErrMalformed) {
+			rows = append(rows, importRow{record: number, err: err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		book, err := BookFromMARC(record)
+		rows = append(rows, importRow{record: number, book: book, err: err})
+	}
+
+	return rows, nil
+}
@@ -0,0 +1,136 @@
+package library_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/marc"
+)
+
+func TestImporter(t *testing.T) {
+	now := time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)
+	bookStore := memory.NewMemoryBookStore(memory.WithClock(fixedClock{now: now}))
+	bookService := library.NewBookService(bookStore)
+	importer := library.NewImporter(bookService)
+
+	t.Run("CSVDryRun", func(t *testing.T) {
+		input := "ID,Name,Author,Stock\n" +
+			"1,Go Programming,John Doe,3\n" +
+			"2,,Jane Smith,1\n" +
+			"3,Advanced Go,Jane Smith,many\n"
+
+		report, err := importer.Import(context.Background(), strings.NewReader(input), library.ImportOptions{
+			Format:  library.ImportCSV,
+			DryRun:  true,
+			Columns: map[string]string{"Name": "title"},
+		})
+		if err != nil {
+			t.Fatalf("Import failed: %s", err)
+		}
+		if report.Total != 3 || report.Created != 1 || report.Failed != 2 {
+			t.Errorf("Wrong report: %+v", report)
+		}
+		if len(report.Errors) != 2 || report.Errors[0].Line != 3 || report.Errors[1].Line != 4 {
+			t.Errorf("Wrong row errors: %+v", report.Errors)
+		}
+
+		if _, err := bookStore.LoadBookByID(context.Background(), "1"); err == nil {
+			t.Errorf("Dry run wrote book with id 1")
+		}
+	})
+
+	t.Run("NDJSONUpsertISBN", func(t *testing.T) {
+		_, err := bookService.CreateBook(context.Background(), library.Book{ID: "10", Title: "Old title", ISBN: "978-0-13-419044-0"})
+		if err != nil {
+			t.Fatalf("Failed create book: %s", err)
+		}
+
+		input := `{"id": "11", "title": "The Go Programming Language", "isbn": "9780134190440"}` + "\n" +
+			`{"id": "12", "title": "Learning Go", "isbn": "978-1-4920-7721-3"}` + "\n"
+
+		report, err := importer.Import(context.Background(), strings.NewReader(input), library.ImportOptions{
+			Format: library.ImportNDJSON,
+			Mode:   library.ImportUpsertISBN,
+		})
+		if err != nil {
+			t.Fatalf("Import failed: %s", err)
+		}
+		if report.Created != 1 || report.Updated != 1 || report.Failed != 0 {
+			t.Errorf("Wrong report: %+v", report)
+		}
+
+		updated, err := bookStore.LoadBookByID(context.Background(), "10")
+		if err != nil {
+			t.Fatalf("LoadBookByID failed: %s", err)
+		}
+		if updated.Title != "The Go Programming Language" {
+			t.Errorf("Book with id 10 was not updated: %+v", updated)
+		}
+		if _, err := bookStore.LoadBookByID(context.Background(), "11"); err == nil {
+			t.Errorf("Upsert by isbn created book with id 11")
+		}
+	})
+
+	t.Run("MARC", func(t *testing.T) {
+		mapped := &marc.Record{Leader: marc.DefaultLeader}
+		mapped.AddControlField("001", "20")
+		mapped.AddDataField("020", ' ', ' ', marc.Subfield{Code: 'a', Value: "9781492077213 (paperback)"})
+		mapped.AddDataField("100", '1', ' ', marc.Subfield{Code: 'a', Value: "Bodner, Jon,"})
+		mapped.AddDataField("245", '1', '0', marc.Subfield{Code: 'a', Value: "Learning Go :"}, marc.Subfield{Code: 'b', Value: "an idiomatic approach /"})
+		mapped.AddDataField("264", ' ', '1', marc.Subfield{Code: 'b', Value: "O'Reilly,"}, marc.Subfield{Code: 'c', Value: "c2021."})
+		mapped.AddDataField("520", ' ', ' ', marc.Subfield{Code: 'a', Value: "Go for experienced programmers."})
+
+		unmapped := &marc.Record{Leader: marc.DefaultLeader}
+		unmapped.AddControlField("001", "21")
+
+		var input bytes.Buffer
+		writer := marc.NewWriter(&input)
+		for _, record := range []*marc.Record{mapped, unmapped} {
+			if err := writer.WriteRecord(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		report, err := importer.Import(context.Background(), &input, library.ImportOptions{Format: library.ImportMARC})
+		if err != nil {
+			t.Fatalf("Import failed: %s", err)
+		}
+		if report.Created != 1 || report.Failed != 1 || report.Errors[0].Record != 2 {
+			t.Errorf("Wrong report: %+v", report)
+		}
+
+		want := library.Book{
+			ID:          "20",
+			Title:       "Learning Go: an idiomatic approach",
+			Author:      "Bodner, Jon",
+			Description: "Go for experienced programmers.",
+			ISBN:        "9781492077213",
+			Publisher:   "O'Reilly",
+			Year:        "2021",
+			Visibility:  library.VisibilityPublic,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		}
+		got, err := bookStore.LoadBookByID(context.Background(), "20")
+		if err != nil {
+			t.Fatalf("LoadBookByID failed: %s", err)
+		}
+		if want != *got {
+			t.Errorf("MARC record mapped wrong: expected %+v but got %+v", want, *got)
+		}
+	})
+
+	t.Run("UnknownColumn", func(t *testing.T) {
+		_, err := importer.Import(context.Background(), strings.NewReader("id,colour\n1,red\n"), library.ImportOptions{
+			Format: library.ImportCSV,
+		})
+		if err == nil {
+			t.Errorf("Import accepted unknown column")
+		}
+	})
+}
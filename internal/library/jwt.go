@@ -0,0 +1,305 @@
+package library
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Claim holding the permission mask when not configured otherwise
+const DefaultPermissionsClaim = "permissions"
+
+// JWTKey is a key tokens may be signed with
+type JWTKey struct {
+	// Key ID matched against the "kid" header, empty matches any token
+	ID string
+	// Only tokens signed with this algorithm are verified with the key: HS256, RS256 or EdDSA
+	Algorithm string
+	// []byte for HS256, *rsa.PublicKey for RS256, ed25519.PublicKey for EdDSA
+	Key any
+}
+
+// JWTUserService resolves tokens by verifying them as signed JWTs,
+// without calling the user service. The user is taken from the "sub" claim
+// and the permission mask from the permissions claim.
+type JWTUserService struct {
+	keys             []JWTKey
+	permissionsClaim string
+	parser           *jwt.Parser
+}
+
+type jwtConfig struct {
+	audience         string
+	issuer           string
+	leeway           time.Duration
+	permissionsClaim string
+	clock            Clock
+}
+
+// JWTOption configures a JWTUserService
+type JWTOption func(*jwtConfig)
+
+// WithJWTAudience requires the "aud" claim to contain the audience
+func WithJWTAudience(audience string) JWTOption {
+	return func(c *jwtConfig) { c.audience = audience }
+}
+
+// WithJWTIssuer requires the "iss" claim to be the issuer
+func WithJWTIssuer(issuer string) JWTOption {
+	return func(c *jwtConfig) { c.issuer = issuer }
+}
+
+// WithJWTLeeway tolerates clock skew when checking "exp" and "nbf"
+func WithJWTLeeway(leeway time.Duration) JWTOption {
+	return func(c *jwtConfig) { c.leeway = leeway }
+}
+
+// WithJWTPermissionsClaim sets the claim holding the permission mask
+func WithJWTPermissionsClaim(claim string) JWTOption {
+	return func(c *jwtConfig) { c.permissionsClaim = claim }
+}
+
+// WithJWTClock sets the clock token lifetimes are checked by
+func WithJWTClock(clock Clock) JWTOption {
+	return func(c *jwtConfig) { c.clock = clock }
+}
+
+func NewJWTUserService(keys []JWTKey, opts ...JWTOption) (*JWTUserService, error) {
+	if len(keys) == 0 {
+		return nil, errors.Wrap(oops.ErrJWTKeys, "no keys configured")
+	}
+
+	cfg := jwtConfig{permissionsClaim: DefaultPermissionsClaim, clock: SystemClock}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	// Only algorithms of configured keys are accepted, which rules out "none"
+	// and tokens signed with a public key used as an HMAC secret
+	var methods []string
+	for _, key := range keys {
+		if err := checkJWTKey(key); err != nil {
+			return nil, err
+		}
+		methods = append(methods, key.Algorithm)
+	}
+
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(cfg.leeway),
+		jwt.WithTimeFunc(cfg.clock.Now),
+		jwt.WithJSONNumber(),
+	}
+	if cfg.audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(cfg.audience))
+	}
+	if cfg.issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(cfg.issuer))
+	}
+
+	return &JWTUserService{
+		keys:             keys,
+		permissionsClaim: cfg.permissionsClaim,
+		parser:           jwt.NewParser(parserOpts...),
+	}, nil
+}
+
+// Verify the token and read the principal from its claims
+func (s *JWTUserService) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := s.parser.ParseWithClaims(token, claims, s.keyFor); err != nil {
+		return nil, errors.Wrap(oops.ErrInvalidToken, err.Error())
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return nil, errors.Wrap(oops.ErrInvalidToken, err.Error())
+	}
+
+	permissions, err := permissionsClaim(claims[s.permissionsClaim])
+	if err != nil {
+		return nil, errors.Wrapf(oops.ErrInvalidToken, "claim %q: %v", s.permissionsClaim, err)
+	}
+
+	return NewPrincipal(subject, token, permissions), nil
+}
+
+// Pick the keys matching the token's algorithm and key ID
+func (s *JWTUserService) keyFor(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	var set jwt.VerificationKeySet
+	for _, key := range s.keys {
+		if key.Algorithm != token.Method.Alg() || (kid != "" && key.ID != "" && key.ID != kid) {
+			continue
+		}
+		set.Keys = append(set.Keys, key.Key)
+	}
+	if len(set.Keys) == 0 {
+		return nil, fmt.Errorf("no %s key with id %q", token.Method.Alg(), kid)
+	}
+	return set, nil
+}
+
+// The mask is either a JSON number or a decimal string, as the user service sends it
+func permissionsClaim(value any) (uint, error) {
+	var s string
+	switch v := value.(type) {
+	case json.Number:
+		s = v.String()
+	case string:
+		s = v
+	case nil:
+		return 0, errors.New("missing")
+	default:
+		return 0, fmt.Errorf("unexpected type %T", value)
+	}
+
+	permissions, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return uint(permissions), nil
+}
+
+func checkJWTKey(key JWTKey) error {
+	var ok bool
+	switch key.Algorithm {
+	case jwt.SigningMethodHS256.Alg():
+		var secret []byte
+		secret, ok = key.Key.([]byte)
+		ok = ok && len(secret) > 0
+	case jwt.SigningMethodRS256.Alg():
+		_, ok = key.Key.(*rsa.PublicKey)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, ok = key.Key.(ed25519.PublicKey)
+	default:
+		return errors.Wrapf(oops.ErrJWTKeys, "unsupported algorithm %q", key.Algorithm)
+	}
+	if !ok {
+		return errors.Wrapf(oops.ErrJWTKeys, "key %q doesn't suit %s", key.ID, key.Algorithm)
+	}
+	return nil
+}
+
+// HMACKey makes an HS256 key out of a shared secret
+func HMACKey(secret string) JWTKey {
+	return JWTKey{Algorithm: jwt.SigningMethodHS256.Alg(), Key: []byte(secret)}
+}
+
+// LoadPEMKey reads an RSA or Ed25519 public key in PEM format
+func LoadPEMKey(path string) (JWTKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return JWTKey{}, errors.Wrap(oops.ErrJWTKeys, err.Error())
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return JWTKey{}, errors.Wrapf(oops.ErrJWTKeys, "%s: no PEM block", path)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		// PKCS #1 "RSA PUBLIC KEY" blocks
+		rsaKey, rsaErr := x509.ParsePKCS1PublicKey(block.Bytes)
+		if rsaErr != nil {
+			return JWTKey{}, errors.Wrapf(oops.ErrJWTKeys, "%s: %v", path, err)
+		}
+		pub = rsaKey
+	}
+
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		return JWTKey{Algorithm: jwt.SigningMethodRS256.Alg(), Key: key}, nil
+	case ed25519.PublicKey:
+		return JWTKey{Algorithm: jwt.SigningMethodEdDSA.Alg(), Key: key}, nil
+	default:
+		return JWTKey{}, errors.Wrapf(oops.ErrJWTKeys, "%s: unsupported key type %T", path, pub)
+	}
+}
+
+// LoadJWKS reads a JSON Web Key Set (RFC 7517) file.
+// Supported are symmetric ("oct"), RSA and Ed25519 ("OKP") keys.
+func LoadJWKS(path string) ([]JWTKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(oops.ErrJWTKeys, err.Error())
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Wrapf(oops.ErrJWTKeys, "%s: %v", path, err)
+	}
+
+	var keys []JWTKey
+	for _, jwk := range set.Keys {
+		// Encryption keys are of no use here
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key := JWTKey{ID: jwk.Kid, Algorithm: jwk.Alg}
+		switch jwk.Kty {
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+			if err != nil {
+				return nil, errors.Wrapf(oops.ErrJWTKeys, "%s: key %q: %v", path, jwk.Kid, err)
+			}
+			key.Key = secret
+			if key.Algorithm == "" {
+				key.Algorithm = jwt.SigningMethodHS256.Alg()
+			}
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+				return nil, errors.Wrapf(oops.ErrJWTKeys, "%s: key %q: malformed RSA key", path, jwk.Kid)
+			}
+			key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+			if key.Algorithm == "" {
+				key.Algorithm = jwt.SigningMethodRS256.Alg()
+			}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, errors.Wrapf(oops.ErrJWTKeys, "%s: key %q: unsupported OKP key", path, jwk.Kid)
+			}
+			key.Key = ed25519.PublicKey(x)
+			if key.Algorithm == "" {
+				key.Algorithm = jwt.SigningMethodEdDSA.Alg()
+			}
+		default:
+			// Other key types may be used by other services sharing the set
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,139 @@
+package library_test
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+func TestJWTUserService(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)
+	dir := t.TempDir()
+
+	// RSA key published in a JWKS file
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, _ := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "rsa-1",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+	}}})
+	jwksPath := filepath.Join(dir, "jwks.json")
+	if err := os.WriteFile(jwksPath, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Ed25519 key in a PEM file
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(edPub)
+	pemPath := filepath.Join(dir, "ed25519.pem")
+	if err := os.WriteFile(pemPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := library.LoadJWKS(jwksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edKeyConfig, err := library.LoadPEMKey(pemPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, edKeyConfig, library.HMACKey("secret"))
+
+	users, err := library.NewJWTUserService(keys,
+		library.WithJWTAudience("book-service"),
+		library.WithJWTClock(fixedClock{now: now}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(changes jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub":         "42",
+			"aud":         "book-service",
+			"exp":         now.Add(time.Hour).Unix(),
+			"permissions": library.PermManageBooks,
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, key any, kid string, c jwt.MapClaims) string {
+		token := jwt.NewWithClaims(method, c)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{"HS256", sign(jwt.SigningMethodHS256, []byte("secret"), "", claims(nil)), false},
+		{"RS256", sign(jwt.SigningMethodRS256, rsaKey, "rsa-1", claims(nil)), false},
+		{"EdDSA", sign(jwt.SigningMethodEdDSA, edKey, "", claims(nil)), false},
+		{"permissions as string", sign(jwt.SigningMethodHS256, []byte("secret"), "", claims(jwt.MapClaims{"permissions": "1"})), false},
+		{"wrong secret", sign(jwt.SigningMethodHS256, []byte("guess"), "", claims(nil)), true},
+		{"unknown key id", sign(jwt.SigningMethodRS256, rsaKey, "rsa-2", claims(nil)), true},
+		{"unsigned", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims(nil)), true},
+		{"expired", sign(jwt.SigningMethodHS256, []byte("secret"), "", claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})), true},
+		{"without expiry", sign(jwt.SigningMethodHS256, []byte("secret"), "", claims(jwt.MapClaims{"exp": nil})), true},
+		{"not yet valid", sign(jwt.SigningMethodHS256, []byte("secret"), "", claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()})), true},
+		{"other audience", sign(jwt.SigningMethodHS256, []byte("secret"), "", claims(jwt.MapClaims{"aud": "user-service"})), true},
+		{"without permissions", sign(jwt.SigningMethodHS256, []byte("secret"), "", claims(jwt.MapClaims{"permissions": nil})), true},
+		{"garbage", "not.a.token", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := users.Authenticate(ctx, tt.token)
+			if tt.wantErr {
+				if !errors.Is(err, oops.ErrInvalidToken) {
+					t.Errorf("want %v, got %v", oops.ErrInvalidToken, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if principal.UserID != "42" || !principal.HasAll(library.PermManageBooks) {
+				t.Errorf("wrong principal %+v", principal)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package library
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type loggerKey struct{}
+
+// WithLogger stores the logger in the context, the service and stores log through it
+func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFromContext returns the logger of the request, or the default one outside of requests
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Details learned while the request is served, for the access log
+type requestDetails struct {
+	user string
+}
+
+type requestDetailsKey struct{}
+
+// Remember the caller for the access log and tag further log records with them
+func logPrincipal(ctx context.Context, p *Principal) context.Context {
+	if details, ok := ctx.Value(requestDetailsKey{}).(*requestDetails); ok {
+		details.user = p.UserID
+	}
+	return WithLogger(ctx, LoggerFromContext(ctx).With("user", p.UserID))
+}
+
+// AccessLog writes a record for every served request and puts a logger tagged with
+// the request ID (and trace ID, if traced) into the request context. It must be used after
+// middleware.RequestID on the root router, which knows the whole route pattern once the request is served.
+func AccessLog(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			requestLogger := logger.With("request_id", middleware.GetReqID(r.Context()))
+			if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+				requestLogger = requestLogger.With("trace_id", sc.TraceID().String())
+			}
+			details := &requestDetails{}
+
+			ctx := WithLogger(r.Context(), requestLogger)
+			ctx = context.WithValue(ctx, requestDetailsKey{}, details)
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+			logRequest := func(aborted bool) {
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+				level := slog.LevelInfo
+				if status >= http.StatusInternalServerError || aborted {
+					level = slog.LevelError
+				}
+
+				var route string
+				if rctx := chi.RouteContext(ctx); rctx != nil {
+					route = rctx.RoutePattern()
+				}
+				attrs := []slog.Attr{
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.String("route", route),
+					slog.Int("status", status),
+					slog.Int("bytes", ww.BytesWritten()),
+					slog.Duration("latency", time.Since(start)),
+					slog.String("user", details.user),
+					slog.String("remote_addr", r.RemoteAddr),
+				}
+				if aborted {
+					attrs = append(attrs, slog.Bool("aborted", true))
+				}
+				requestLogger.LogAttrs(ctx, level, "request", attrs...)
+			}
+			// Handlers cut responses that fail halfway with a panic, which must not skip the record
+			defer func() {
+				if p := recover(); p != nil {
+					logRequest(true)
+					panic(p)
+				}
+			}()
+
+			next.ServeHTTP(ww, r.WithContext(ctx))
+			logRequest(false)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package library_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/mock"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID, library.AccessLog(logger))
+	users := &mock.MockUserServiceClient{UserID: "7", Permissions: library.PermManageBooks}
+	library.NewHandler(router, library.NewBookService(memory.NewMemoryBookStore()), users).Register()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/books/new", strings.NewReader(`{"id": "1", "title": "Go Programming"}`))
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("X-Request-ID", "req-7")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	records := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("malformed record %q: %s", line, err)
+		}
+		records[record["msg"].(string)] = record
+	}
+
+	// The service logs through the request logger
+	created, ok := records["book created"]
+	if !ok || created["request_id"] != "req-7" || created["user"] != "7" || created["book_id"] != "1" {
+		t.Errorf("wrong service record %v", created)
+	}
+
+	access, ok := records["request"]
+	if !ok {
+		t.Fatalf("no access record in %q", buf.String())
+	}
+	for key, want := range map[string]any{
+		"request_id": "req-7",
+		"method":     http.MethodPost,
+		"route":      "/api/v1/books/new",
+		"status":     float64(http.StatusCreated),
+		"user":       "7",
+	} {
+		if access[key] != want {
+			t.Errorf("access record: want %s %v, got %v", key, want, access[key])
+		}
+	}
+	if _, ok := access["latency"]; !ok {
+		t.Error("access record has no latency")
+	}
+}
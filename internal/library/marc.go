@@ -0,0 +1,186 @@
+package library
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/marc"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// BookToMARC maps a book onto a MARC 21 bibliographic record
+func BookToMARC(book Book) *marc.Record {
+	record := &marc.Record{Leader: marc.DefaultLeader}
+	record.AddControlField("001", book.ID)
+	if book.ISBN != "" {
+		record.AddDataField("020", ' ', ' ', marc.Subfield{Code: 'a', Value: book.ISBN})
+	}
+
+	// The first author is the main entry, the rest are added entries
+	authors := book.Authors()
+	for i, author := range authors {
+		tag := "700"
+		if i == 0 {
+			tag = "100"
+		}
+		record.AddDataField(tag, '1', ' ', marc.Subfield{Code: 'a', Value: author})
+	}
+
+	// Title is traced as an added entry only when there is a main entry
+	titleInd := byte('0')
+	if len(authors) > 0 {
+		titleInd = '1'
+	}
+	record.AddDataField("245", titleInd, '0', marc.Subfield{Code: 'a', Value: book.Title})
+
+	if book.Publisher != "" || book.Year != "" {
+		var subfields []marc.Subfield
+		if book.Publisher != "" {
+			subfields = append(subfields, marc.Subfield{Code: 'b', Value: book.Publisher})
+		}
+		if book.Year != "" {
+			subfields = append(subfields, marc.Subfield{Code: 'c', Value: book.Year})
+		}
+		record.AddDataField("264", ' ', '1', subfields...)
+	}
+	if book.Description != "" {
+		record.AddDataField("520", ' ', ' ', marc.Subfield{Code: 'a', Value: book.Description})
+	}
+	return record
+}
+
+// BookFromMARC maps a MARC 21 bibliographic record onto a book.
+// Records without a title or any usable identifier can't be mapped.
+func BookFromMARC(record *marc.Record) (Book, error) {
+	var book Book
+
+	// Only UTF-8 records are decoded, MARC-8 is fine as long as it's plain ASCII
+	if len(record.Leader) > 9 && record.Leader[9] != 'a' && !isASCII(record) {
+		return book, errors.Wrap(oops.ErrUnmappedRecord, "MARC-8 encoded characters are not supported")
+	}
+
+	for _, f := range record.FieldsByTag("001") {
+		book.ID = strings.TrimSpace(f.Value)
+	}
+
+	// Qualifiers follow the number: "9780134190440 (paperback)"
+	for _, f := range record.FieldsByTag("020") {
+		isbn := NormalizeISBN(firstWord(f.Subfield('a')))
+		if isbn == "" {
+			continue
+		}
+		if book.ISBN == "" || (!ValidISBN(book.ISBN) && ValidISBN(isbn)) {
+			book.ISBN = isbn
+		}
+	}
+	if book.ID == "" {
+		book.ID = book.ISBN
+	}
+
+	var authors []string
+	for _, tag := range []string{"100", "700"} {
+		for _, f := range record.FieldsByTag(tag) {
+			if name := trimPunctuation(f.Subfield('a')); name != "" {
+				authors = append(authors, name)
+			}
+		}
+	}
+	book.Author = strings.Join(authors, authorSeparator)
+
+	for _, f := range record.FieldsByTag("245") {
+		title := trimPunctuation(f.Subfield('a'))
+		if subtitle := trimPunctuation(f.Subfield('b')); subtitle != "" {
+			title += ": " + subtitle
+		}
+		book.Title = title
+	}
+
+	var summaries []string
+	for _, f := range record.FieldsByTag("520") {
+		if summary := strings.TrimSpace(f.Subfield('a')); summary != "" {
+			summaries = append(summaries, summary)
+		}
+	}
+	book.Description = strings.Join(summaries, "\n\n")
+
+	// RDA records use 264 with second indicator 1 for publication, older ones use 260
+	publication := record.FieldsByTag("260")
+	for _, f := range record.FieldsByTag("264") {
+		if f.Ind2 == '1' {
+			publication = []marc.Field{f}
+		}
+	}
+	for _, f := range publication {
+		book.Publisher = trimPunctuation(f.Subfield('b'))
+		book.Year = findYear(f.Subfield('c'))
+	}
+
+	if book.ID == "" {
+		return book, errors.Wrap(oops.ErrUnmappedRecord, "no control number (001) or ISBN (020)")
+	}
+	if book.Title == "" {
+		return book, errors.Wrap(oops.ErrUnmappedRecord, "no title (245)")
+	}
+	return book, nil
+}
+
+func firstWord(s string) string {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+// Strip ISBD punctuation MARC puts at the end of subfields ("Title /", "Name,").
+// A final period is kept after initials ("Donovan, Alan A. A.").
+func trimPunctuation(s string) string {
+	s = strings.TrimRight(strings.TrimSpace(s), " /:;,=")
+	if strings.HasSuffix(s, ".") {
+		words := strings.Fields(s)
+		last := strings.TrimSuffix(words[len(words)-1], ".")
+		if utf8.RuneCountInString(last) != 1 {
+			s = strings.TrimSuffix(s, ".")
+		}
+	}
+	return s
+}
+
+// Extract the first four digit run from a date like "c2015." or "[1998?]"
+func findYear(s string) string {
+	run := 0
+	for i, r := range s {
+		if !unicode.IsDigit(r) || r > unicode.MaxASCII {
+			run = 0
+			continue
+		}
+		run++
+		if run == 4 && (i+1 == len(s) || s[i+1] < '0' || s[i+1] > '9') {
+			return s[i-3 : i+1]
+		}
+	}
+	return ""
+}
+
+func isASCII(record *marc.Record) bool {
+	for _, f := range record.Fields {
+		for _, value := range append([]string{f.Value}, subfieldValues(f)...) {
+			for i := 0; i < len(value); i++ {
+				if value[i] >= utf8.RuneSelf {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+func subfieldValues(f marc.Field) []string {
+	values := make([]string, 0, len(f.Subfields))
+	for _, sf := range f.Subfields {
+		values = append(values, sf.Value)
+	}
+	return values
+}
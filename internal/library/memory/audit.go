@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"context"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+func (s *MemoryBookStore) AuditChange(ctx context.Context, change library.BookChange) (library.AuditEntry, error) {
+	s.mu.Lock()
+	s.auditMu.Lock()
+	defer s.mu.Unlock()
+	defer s.auditMu.Unlock()
+
+	tx := s.begin()
+	entry, err := change(ctx, tx)
+	if err != nil {
+		return entry, err
+	}
+
+	prevHash := ""
+	if n := len(s.audit); n > 0 {
+		prevHash = s.audit[n-1].Hash
+	}
+
+	entry.Seq = int64(len(s.audit)) + 1
+	entry.Time = s.now()
+	if err := library.SealAuditEntry(&entry, prevHash); err != nil {
+		return entry, err
+	}
+	if err := s.commit(tx, &entry); err != nil {
+		return entry, err
+	}
+
+	library.LoggerFromContext(ctx).Debug("appended audit entry", "seq", entry.Seq, "hash", entry.Hash)
+	return entry, nil
+}
+
+func (s *MemoryBookStore) LoadAudit(ctx context.Context, filter library.AuditFilter) ([]library.AuditEntry, error) {
+	s.auditMu.RLock()
+	defer s.auditMu.RUnlock()
+
+	var result []library.AuditEntry
+	for _, entry := range s.audit {
+		if !auditMatches(entry, filter) {
+			continue
+		}
+		result = append(result, entry)
+		if filter.Limit > 0 && len(result) == filter.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *MemoryBookStore) IterateAudit(ctx context.Context, fn func(library.AuditEntry) error) error {
+	// Entries are never changed, so a copy of the slice header is enough
+	s.auditMu.RLock()
+	entries := s.audit
+	s.auditMu.RUnlock()
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check whether the audit entry passes the filter
+func auditMatches(entry library.AuditEntry, filter library.AuditFilter) bool {
+	switch {
+	case filter.Actor != "" && entry.Actor != filter.Actor,
+		filter.Action != "" && entry.Action != filter.Action,
+		filter.BookID != "" && entry.BookID != filter.BookID,
+		!filter.Since.IsZero() && entry.Time.Before(filter.Since),
+		!filter.Until.IsZero() && !entry.Time.Before(filter.Until),
+		entry.Seq <= filter.AfterSeq:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,40 @@
+package memory_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+)
+
+func TestMemoryBookStore_AuditChange_rollback(t *testing.T) {
+	ctx := context.Background()
+	store := memory.NewMemoryBookStore()
+	if _, err := store.SaveBook(ctx, library.Book{ID: "1", Title: "Go Programming"}); err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("no entry")
+	_, err := store.AuditChange(ctx, func(ctx context.Context, books library.BookStore) (library.AuditEntry, error) {
+		if err := books.UpdateBook(ctx, "1", library.Book{Title: "The Go Programming Language"}); err != nil {
+			return library.AuditEntry{}, err
+		}
+		// The change sees its own write
+		if book, err := books.LoadBookByID(ctx, "1"); err != nil || book.Title != "The Go Programming Language" {
+			t.Errorf("want the change to see its write, got %+v, %v", book, err)
+		}
+		return library.AuditEntry{}, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("want %v, got %v", failure, err)
+	}
+
+	if book, err := store.LoadBookByID(ctx, "1"); err != nil || book.Title != "Go Programming" {
+		t.Errorf("want the change discarded, got %+v, %v", book, err)
+	}
+	if entries, _ := store.LoadAudit(ctx, library.AuditFilter{}); len(entries) != 0 {
+		t.Errorf("want no entry, got %+v", entries)
+	}
+}
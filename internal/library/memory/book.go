@@ -2,7 +2,10 @@ package memory
 
 import (
 	"context"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
 	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
@@ -11,74 +14,331 @@ import (
 type MemoryBookStore struct {
 	mu    sync.RWMutex
 	books map[string]library.Book
+	clock library.Clock
+
+	auditMu sync.RWMutex
+	audit   []library.AuditEntry
+
+	// Files the store is kept in, nil wal when changes aren't logged
+	persistence Persistence
+	wal         *writeAheadLog
 }
 
-func NewMemoryBookStore() *MemoryBookStore {
-	return &MemoryBookStore{
+// Option configures MemoryBookStore
+type Option func(*MemoryBookStore)
+
+// WithClock makes the store stamp changes with the given clock
+func WithClock(clock library.Clock) Option {
+	return func(s *MemoryBookStore) {
+		s.clock = clock
+	}
+}
+
+func NewMemoryBookStore(opts ...Option) *MemoryBookStore {
+	s := &MemoryBookStore{
 		books: make(map[string]library.Book),
+		clock: library.SystemClock,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
+}
+
+func (s *MemoryBookStore) LoadBooks(ctx context.Context, filter library.BookFilter) ([]library.Book, error) {
+	return s.search(filter), nil
 }
 
-func (s *MemoryBookStore) LoadBooks(ctx context.Context, criteria string) ([]library.Book, error) {
+func (s *MemoryBookStore) IterateBooks(ctx context.Context, filter library.BookFilter, fn func(library.Book) error) error {
+	// Work on a copy so that fn runs without holding the lock
+	return iterate(ctx, s.search(filter), fn)
+}
+
+func (s *MemoryBookStore) LoadBookByID(ctx context.Context, id string, visibility ...library.Visibility) (*library.Book, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	var result []library.Book
+	return s.begin().LoadBookByID(ctx, id, visibility...)
+}
+
+func (s *MemoryBookStore) LoadBookByISBN(ctx context.Context, isbn string, visibility ...library.Visibility) (*library.Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.begin().LoadBookByISBN(ctx, isbn, visibility...)
+}
+
+func (s *MemoryBookStore) SaveBook(ctx context.Context, book library.Book) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin()
+	id, err := tx.SaveBook(ctx, book)
+	if err != nil {
+		return "", err
+	}
+	return id, s.commit(tx, nil)
+}
+
+func (s *MemoryBookStore) UpdateBook(ctx context.Context, id string, book library.Book) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin()
+	if err := tx.UpdateBook(ctx, id, book); err != nil {
+		return err
+	}
+	return s.commit(tx, nil)
+}
+
+func (s *MemoryBookStore) DeleteBook(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := s.begin()
+	if err := tx.DeleteBook(ctx, id); err != nil {
+		return err
+	}
+	return s.commit(tx, nil)
+}
+
+func (s *MemoryBookStore) CountBooks(ctx context.Context) (library.CatalogueCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	count := library.CatalogueCount{Books: make(map[library.Visibility]int)}
 	for _, book := range s.books {
-		// Lookup for the same substring in in book title, author or decription
-		if strContains(book.Title, criteria) || strContains(book.Author, criteria) || strContains(book.Description, criteria) {
-			result = append(result, book)
+		if book.DeletedAt != nil {
+			continue
 		}
+		count.Books[book.Visibility]++
+		// Stock is validated on the way in
+		n, _ := strconv.Atoi(book.Stock)
+		count.Stock += n
 	}
-	return result, nil
+	return count, nil
+}
+
+// Current time as stored in books
+func (s *MemoryBookStore) now() time.Time {
+	return s.clock.Now().UTC()
 }
 
-func (s *MemoryBookStore) LoadBookByID(ctx context.Context, id string) (*library.Book, error) {
+// Collect books passing the filter, ordered by ID
+func (s *MemoryBookStore) search(filter library.BookFilter) []library.Book {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	book, exists := s.books[id]
-	if !exists {
+	return s.begin().search(filter)
+}
+
+// Change in progress: books are staged over the stored ones and written together by commit.
+// Must be used with the mutex held, the write lock for changes.
+type bookTx struct {
+	s      *MemoryBookStore
+	staged map[string]library.Book
+}
+
+func (s *MemoryBookStore) begin() *bookTx {
+	return &bookTx{s: s}
+}
+
+// Store the staged books and the audit entry, if any, logging them first as one record,
+// so that a crash keeps both or neither. Must be called with the mutex held, and the audit
+// mutex as well for an entry.
+func (s *MemoryBookStore) commit(tx *bookTx, entry *library.AuditEntry) error {
+	record := walRecord{Audit: entry}
+	for _, book := range tx.staged {
+		record.Books = append(record.Books, book)
+	}
+	if s.wal != nil {
+		if err := s.wal.append(record); err != nil {
+			return err
+		}
+	}
+
+	for id, book := range tx.staged {
+		s.books[id] = book
+	}
+	if entry != nil {
+		s.audit = append(s.audit, *entry)
+	}
+	return nil
+}
+
+// The book as the change sees it
+func (tx *bookTx) get(id string) (library.Book, bool) {
+	if book, ok := tx.staged[id]; ok {
+		return book, true
+	}
+	book, ok := tx.s.books[id]
+	return book, ok
+}
+
+func (tx *bookTx) put(book library.Book) {
+	if tx.staged == nil {
+		tx.staged = make(map[string]library.Book)
+	}
+	tx.staged[book.ID] = book
+}
+
+// Call fn for every book as the change sees it, in no particular order, until fn returns false
+func (tx *bookTx) each(fn func(library.Book) bool) {
+	for id, book := range tx.s.books {
+		if _, ok := tx.staged[id]; !ok && !fn(book) {
+			return
+		}
+	}
+	for _, book := range tx.staged {
+		if !fn(book) {
+			return
+		}
+	}
+}
+
+func (tx *bookTx) search(filter library.BookFilter) []library.Book {
+	var result []library.Book
+	tx.each(func(book library.Book) bool {
+		if matches(book, filter) {
+			result = append(result, book)
+		}
+		return true
+	})
+
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	if filter.Limit > 0 && len(result) > filter.Limit {
+		result = result[:filter.Limit]
+	}
+	return result
+}
+
+func (tx *bookTx) LoadBooks(ctx context.Context, filter library.BookFilter) ([]library.Book, error) {
+	return tx.search(filter), nil
+}
+
+func (tx *bookTx) IterateBooks(ctx context.Context, filter library.BookFilter, fn func(library.Book) error) error {
+	return iterate(ctx, tx.search(filter), fn)
+}
+
+func (tx *bookTx) LoadBookByID(ctx context.Context, id string, visibility ...library.Visibility) (*library.Book, error) {
+	book, exists := tx.get(id)
+	if !exists || book.DeletedAt != nil || !visible(book, visibility) {
 		return nil, oops.ErrUnexistedBook
 	}
 	return &book, nil
 }
-func (s *MemoryBookStore) SaveBook(ctx context.Context, book library.Book) (string, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
 
-	if _, exists := s.books[book.ID]; exists {
+func (tx *bookTx) LoadBookByISBN(ctx context.Context, isbn string, visibility ...library.Visibility) (*library.Book, error) {
+	if isbn == "" {
+		return nil, oops.ErrUnexistedBook
+	}
+
+	var found *library.Book
+	tx.each(func(book library.Book) bool {
+		if book.ISBN == isbn && book.DeletedAt == nil && visible(book, visibility) {
+			found = &book
+		}
+		return found == nil
+	})
+	if found == nil {
+		return nil, oops.ErrUnexistedBook
+	}
+	return found, nil
+}
+
+func (tx *bookTx) SaveBook(ctx context.Context, book library.Book) (string, error) {
+	// Tombstones of deleted books may be replaced
+	if old, exists := tx.get(book.ID); exists && old.DeletedAt == nil {
 		return "", oops.ErrDuplicateID
 	}
 
-	s.books[book.ID] = book
+	now := tx.s.now()
+	book.CreatedAt, book.UpdatedAt, book.DeletedAt = now, now, nil
+	if book.Visibility == "" {
+		book.Visibility = library.VisibilityPublic
+	}
+	tx.put(book)
 	return book.ID, nil
 }
 
-func (s *MemoryBookStore) UpdateBook(ctx context.Context, id string, book library.Book) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.books[id]; !exists {
+func (tx *bookTx) UpdateBook(ctx context.Context, id string, book library.Book) error {
+	old, exists := tx.get(id)
+	if !exists || old.DeletedAt != nil {
 		return oops.ErrUnexistedBook
 	}
 
-	s.books[id] = book
+	book.ID = id
+	book.CreatedAt, book.UpdatedAt, book.DeletedAt = old.CreatedAt, tx.s.now(), nil
+	// Visibility is only changed when given
+	if book.Visibility == "" {
+		book.Visibility = old.Visibility
+	}
+	tx.put(book)
 	return nil
 }
 
-func (s *MemoryBookStore) DeleteBook(ctx context.Context, id string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	if _, exists := s.books[id]; !exists {
+func (tx *bookTx) DeleteBook(ctx context.Context, id string) error {
+	book, exists := tx.get(id)
+	if !exists || book.DeletedAt != nil {
 		return oops.ErrUnexistedBook
 	}
 
-	delete(s.books, id)
+	// Keep a tombstone so that harvesters learn about the deletion
+	now := tx.s.now()
+	book.UpdatedAt, book.DeletedAt = now, &now
+	tx.put(book)
 	return nil
 }
 
+// Pass the books to fn one by one, stopping at the first error
+func iterate(ctx context.Context, books []library.Book, fn func(library.Book) error) error {
+	for _, book := range books {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check whether the book passes the filter
+func matches(book library.Book, filter library.BookFilter) bool {
+	if book.DeletedAt != nil && !filter.IncludeDeleted {
+		return false
+	}
+	if !filter.UpdatedSince.IsZero() && book.UpdatedAt.Before(filter.UpdatedSince) {
+		return false
+	}
+	if !filter.UpdatedBefore.IsZero() && !book.UpdatedAt.Before(filter.UpdatedBefore) {
+		return false
+	}
+	if filter.AfterID != "" && book.ID <= filter.AfterID {
+		return false
+	}
+	if !visible(book, filter.Visibility) {
+		return false
+	}
+
+	// Lookup for the same substring in in book title, author or decription
+	criteria := filter.Criteria
+	return strContains(book.Title, criteria) || strContains(book.Author, criteria) || strContains(book.Description, criteria)
+}
+
+// Check whether the book has one of the visibilities, any book passes an empty list
+func visible(book library.Book, visibility []library.Visibility) bool {
+	if len(visibility) == 0 {
+		return true
+	}
+	for _, v := range visibility {
+		if book.Visibility == v {
+			return true
+		}
+	}
+	return false
+}
+
 // Simple search in db
 func strContains(str, substr string) bool {
 	if substr == "" {
@@ -0,0 +1,208 @@
+package memory
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/pkg/errors"
+)
+
+// Persistence keeps the store in files, so that it outlives the process
+type Persistence struct {
+	// SnapshotFile receives the whole store on every checkpoint, it's read back on open
+	SnapshotFile string
+	// WAL appends every change to SnapshotFile + ".wal" before applying it, so that
+	// changes made since the last checkpoint survive a crash
+	WAL bool
+}
+
+// OpenMemoryBookStore restores the store from the snapshot and replays the write-ahead
+// log over it. A record torn by a crash at the end of the log is dropped.
+func OpenMemoryBookStore(p Persistence, opts ...Option) (*MemoryBookStore, error) {
+	s := NewMemoryBookStore(opts...)
+	s.persistence = p
+	if p.SnapshotFile == "" {
+		return s, nil
+	}
+
+	snapshot, err := readSnapshot(p.SnapshotFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "snapshot %s", p.SnapshotFile)
+	}
+	s.Restore(snapshot)
+	if !p.WAL {
+		return s, nil
+	}
+
+	s.wal, err = openWAL(p.SnapshotFile + ".wal")
+	if err != nil {
+		return nil, err
+	}
+	replayed, err := s.wal.replay(s.apply)
+	if err != nil {
+		s.wal.file.Close()
+		return nil, err
+	}
+	slog.Info("recovered memory store", "snapshot", p.SnapshotFile, "books", len(snapshot.Books), "replayed", replayed)
+	return s, nil
+}
+
+// Checkpoint writes the snapshot and empties the write-ahead log. Changes wait
+// meanwhile, so that every change is either in the snapshot or in the log.
+// Changes are logged with the write lock held, so read locks keep them out
+// and reads go on while the snapshot is written.
+func (s *MemoryBookStore) Checkpoint() error {
+	if s.persistence.SnapshotFile == "" {
+		return nil
+	}
+
+	s.mu.RLock()
+	s.auditMu.RLock()
+	defer s.mu.RUnlock()
+	defer s.auditMu.RUnlock()
+
+	if err := writeSnapshot(s.persistence.SnapshotFile, s.snapshot()); err != nil {
+		return errors.Wrapf(err, "snapshot %s", s.persistence.SnapshotFile)
+	}
+	if s.wal != nil {
+		return s.wal.truncate()
+	}
+	return nil
+}
+
+// Close writes the last snapshot and releases the log, the store must not be changed afterwards
+func (s *MemoryBookStore) Close() error {
+	err := s.Checkpoint()
+	if s.wal != nil {
+		if closeErr := s.wal.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Change recorded in the write-ahead log: books in their new state and the audit entry describing
+// the change, if any. Replaying a record twice changes nothing, so a log surviving a checkpoint is harmless.
+type walRecord struct {
+	Books []library.Book      `json:"books,omitempty"`
+	Audit *library.AuditEntry `json:"audit,omitempty"`
+}
+
+// Apply the recorded change, with no lock held
+func (s *MemoryBookStore) apply(record walRecord) {
+	s.mu.Lock()
+	for _, book := range record.Books {
+		s.books[book.ID] = book
+	}
+	s.mu.Unlock()
+
+	if record.Audit != nil {
+		s.auditMu.Lock()
+		if record.Audit.Seq > int64(len(s.audit)) {
+			s.audit = append(s.audit, *record.Audit)
+		}
+		s.auditMu.Unlock()
+	}
+}
+
+// Append-only file of JSON records, one per line
+type writeAheadLog struct {
+	mu   sync.Mutex
+	file *os.File
+	// Length of the records written completely
+	size int64
+}
+
+func openWAL(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, errors.Wrap(err, "write-ahead log")
+	}
+	return &writeAheadLog{file: file}, nil
+}
+
+// Apply every complete record in order, then cut off a torn one at the end
+func (w *writeAheadLog) replay(apply func(walRecord)) (int, error) {
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	var count int
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without its newline was being written when the process stopped
+			if len(line) > 0 {
+				slog.Warn("dropped torn write-ahead log record", "file", w.file.Name(), "offset", offset)
+			}
+			break
+		}
+		if err != nil {
+			return count, errors.Wrap(err, "write-ahead log")
+		}
+
+		var record walRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+			return count, errors.Wrap(err, fmt.Sprintf("write-ahead log %s: record at offset %d", w.file.Name(), offset))
+		}
+		apply(record)
+		offset += int64(len(line))
+		count++
+	}
+
+	w.size = offset
+	if err := w.file.Truncate(offset); err != nil {
+		return count, errors.Wrap(err, "write-ahead log")
+	}
+	_, err := w.file.Seek(offset, io.SeekStart)
+	return count, errors.Wrap(err, "write-ahead log")
+}
+
+// Write the record durably. A record that fails half way is cut off, so that the next one follows the last whole record.
+func (w *writeAheadLog) append(record walRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, err := w.file.Write(data); err != nil {
+		w.rollback()
+		return errors.Wrap(err, "write-ahead log")
+	}
+	if err := w.file.Sync(); err != nil {
+		w.rollback()
+		return errors.Wrap(err, "write-ahead log")
+	}
+	w.size += int64(len(data))
+	return nil
+}
+
+// Must be called with the mutex held
+func (w *writeAheadLog) rollback() {
+	w.file.Truncate(w.size)
+	w.file.Seek(w.size, io.SeekStart)
+}
+
+// Empty the log once its records are in the snapshot
+func (w *writeAheadLog) truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "write-ahead log")
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "write-ahead log")
+	}
+	w.size = 0
+	return errors.Wrap(w.file.Sync(), "write-ahead log")
+}
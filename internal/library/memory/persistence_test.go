@@ -0,0 +1,104 @@
+package memory_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+)
+
+func TestOpenMemoryBookStore_recovery(t *testing.T) {
+	ctx := context.Background()
+	persistence := memory.Persistence{SnapshotFile: filepath.Join(t.TempDir(), "books.json"), WAL: true}
+	wal := persistence.SnapshotFile + ".wal"
+
+	open := func() *memory.MemoryBookStore {
+		t.Helper()
+		store, err := memory.OpenMemoryBookStore(persistence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	service := func(store *memory.MemoryBookStore) library.BookService {
+		return library.NewBookService(store, library.WithAudit(store))
+	}
+
+	store := open()
+	for _, book := range []library.Book{{ID: "1", Title: "Go Programming"}, {ID: "2", Title: "The C Programming Language"}} {
+		if _, err := service(store).CreateBook(ctx, book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(wal); err != nil || info.Size() != 0 {
+		t.Fatalf("want log emptied by the checkpoint, got %v, %v", info, err)
+	}
+	if err := service(store).UpdateBook(ctx, "1", library.Book{Title: "The Go Programming Language"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service(store).DeleteBook(ctx, "2"); err != nil {
+		t.Fatal(err)
+	}
+	logged, err := os.ReadFile(wal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The process crashes before the next checkpoint, in the middle of a record
+	f, err := os.OpenFile(wal, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"books":[{"id":"3","ti`)
+	f.Close()
+
+	check := func(store *memory.MemoryBookStore) {
+		t.Helper()
+		book, err := store.LoadBookByID(ctx, "1")
+		if err != nil || book.Title != "The Go Programming Language" {
+			t.Errorf("want update recovered, got %+v, %v", book, err)
+		}
+		if _, err := store.LoadBookByID(ctx, "2"); err == nil {
+			t.Error("want deletion recovered")
+		}
+		if _, err := store.LoadBookByID(ctx, "3"); err == nil {
+			t.Error("want torn record dropped")
+		}
+		verification, err := library.VerifyAuditChain(ctx, store)
+		if err != nil || !verification.OK || verification.Checked != 4 {
+			t.Errorf("want intact audit log of 4 entries, got %+v, %v", verification, err)
+		}
+	}
+	recovered := open()
+	check(recovered)
+
+	// Writes after recovery follow the last whole record
+	if _, err := service(recovered).CreateBook(ctx, library.Book{ID: "4", Title: "Structure and Interpretation of Computer Programs"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := open().LoadBookByID(ctx, "4"); err != nil {
+		t.Errorf("want book created after recovery kept, got %v", err)
+	}
+
+	// A crash between writing the snapshot and emptying the log replays records already in the snapshot
+	if err := recovered.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(wal, logged, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	replayed := open()
+	verification, err := library.VerifyAuditChain(ctx, replayed)
+	if err != nil || !verification.OK || verification.Checked != 5 {
+		t.Errorf("want audit log of 5 entries without duplicates, got %+v, %v", verification, err)
+	}
+	if _, err := replayed.LoadBookByID(ctx, "4"); err != nil {
+		t.Errorf("want book from the snapshot kept, got %v", err)
+	}
+}
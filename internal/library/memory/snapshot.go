@@ -0,0 +1,117 @@
+package memory
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+// Snapshot is the whole content of the store, books ordered by ID and the audit log in order
+type Snapshot struct {
+	Books []library.Book       `json:"books"`
+	Audit []library.AuditEntry `json:"audit"`
+}
+
+// Snapshot copies the content of the store
+func (s *MemoryBookStore) Snapshot() Snapshot {
+	// Both locks are held at once, so that books and the audit log match
+	s.mu.RLock()
+	s.auditMu.RLock()
+	defer s.mu.RUnlock()
+	defer s.auditMu.RUnlock()
+
+	return s.snapshot()
+}
+
+// Must be called with both mutexes held
+func (s *MemoryBookStore) snapshot() Snapshot {
+	snapshot := Snapshot{
+		Books: make([]library.Book, 0, len(s.books)),
+		Audit: append([]library.AuditEntry{}, s.audit...),
+	}
+	for _, book := range s.books {
+		snapshot.Books = append(snapshot.Books, book)
+	}
+	sort.Slice(snapshot.Books, func(i, j int) bool { return snapshot.Books[i].ID < snapshot.Books[j].ID })
+	return snapshot
+}
+
+// Restore replaces the content of the store with the snapshot
+func (s *MemoryBookStore) Restore(snapshot Snapshot) {
+	books := make(map[string]library.Book, len(snapshot.Books))
+	for _, book := range snapshot.Books {
+		books[book.ID] = book
+	}
+
+	s.mu.Lock()
+	s.auditMu.Lock()
+	s.books = books
+	s.audit = append([]library.AuditEntry{}, snapshot.Audit...)
+	s.auditMu.Unlock()
+	s.mu.Unlock()
+}
+
+// Write the snapshot to the file. The file is replaced at once, so that
+// a crash while writing leaves the previous snapshot intact.
+func writeSnapshot(path string, snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Make the rename durable, not every platform lets directories be synced
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	d.Sync()
+	return nil
+}
+
+// Read the snapshot from the file, a missing file is an empty store
+func readSnapshot(path string) (Snapshot, error) {
+	var snapshot Snapshot
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
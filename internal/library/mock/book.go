@@ -13,7 +13,7 @@ func NewMockService() *Mock {
 	return &Mock{}
 }
 
-func (m *Mock) GetBooks(ctx context.Context, criteria string) ([]library.Book, error) {
+func (m *Mock) GetBooks(ctx context.Context, filter library.BookFilter) ([]library.Book, error) {
 	return []library.Book{
 		{
 			ID:          "1",
@@ -32,6 +32,17 @@ func (m *Mock) GetBooks(ctx context.Context, criteria string) ([]library.Book, e
 	}, nil
 }
 
+// StreamBooks mocks the StreamBooks method from the BookService interface
+func (m *Mock) StreamBooks(ctx context.Context, filter library.BookFilter, fn func(library.Book) error) error {
+	books, _ := m.GetBooks(ctx, filter)
+	for _, book := range books {
+		if err := fn(book); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetBookByID mocks the GetBookByID method from the BookService interface
 func (m *Mock) GetBookByID(ctx context.Context, id string) (*library.Book, error) {
 	if id == "1" {
@@ -46,6 +57,11 @@ func (m *Mock) GetBookByID(ctx context.Context, id string) (*library.Book, error
 	return nil, nil
 }
 
+// GetBookByISBN mocks the GetBookByISBN method from the BookService interface
+func (m *Mock) GetBookByISBN(ctx context.Context, isbn string) (*library.Book, error) {
+	return nil, nil
+}
+
 func (m *Mock) CreateBook(ctx context.Context, book library.Book) (string, error) {
 	return "3", nil
 }
@@ -59,3 +75,13 @@ func (m *Mock) UpdateBook(ctx context.Context, id string, book library.Book) err
 func (m *Mock) DeleteBook(ctx context.Context, id string) error {
 	return nil
 }
+
+// GetAudit mocks the GetAudit method from the BookService interface
+func (m *Mock) GetAudit(ctx context.Context, filter library.AuditFilter) ([]library.AuditEntry, error) {
+	return nil, nil
+}
+
+// VerifyAudit mocks the VerifyAudit method from the BookService interface
+func (m *Mock) VerifyAudit(ctx context.Context) (library.AuditVerification, error) {
+	return library.AuditVerification{OK: true}, nil
+}
@@ -1,11 +1,27 @@
 package mock
 
-type MockUserServiceClient struct{}
+import (
+	"context"
 
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+// MockUserServiceClient grants the configured permissions to any token,
+// or fails with Err when it is set
+type MockUserServiceClient struct {
+	UserID      string
+	Permissions uint
+	Err         error
+}
+
+// NewMockUserServiceClient creates a client granting every permission
 func NewMockUserServiceClient() *MockUserServiceClient {
-	return &MockUserServiceClient{}
+	return &MockUserServiceClient{Permissions: ^uint(0)}
 }
 
-func (client *MockUserServiceClient) CheckPermissions(token string, mask uint) (bool, error) {
-	return true, nil
+func (client *MockUserServiceClient) Authenticate(ctx context.Context, token string) (*library.Principal, error) {
+	if client.Err != nil {
+		return nil, client.Err
+	}
+	return library.NewPrincipal(client.UserID, token, client.Permissions), nil
 }
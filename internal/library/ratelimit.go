@@ -0,0 +1,185 @@
+package library
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// How often idle clients are forgotten
+const rateLimitSweepInterval = time.Minute
+
+// RateLimit is a token bucket: Rate requests per second on average with bursts of up to Burst requests.
+// A zero Rate lets every request through.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// Burst defaults to one second worth of requests
+func (limit RateLimit) normalized() RateLimit {
+	if limit.Burst <= 0 {
+		limit.Burst = max(1, int(math.Ceil(limit.Rate)))
+	}
+	return limit
+}
+
+// RateLimiter throttles clients one by one. Authenticated callers are told apart
+// by their token, anonymous ones by IP address.
+type RateLimiter struct {
+	limit RateLimit
+	clock Clock
+	key   func(*http.Request) string
+
+	mu        sync.Mutex
+	clients   map[string]*rateClient
+	lastSweep time.Time
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiterOption configures a RateLimiter
+type RateLimiterOption func(*RateLimiter)
+
+// WithRateLimitClock sets the clock buckets are refilled by
+func WithRateLimitClock(clock Clock) RateLimiterOption {
+	return func(l *RateLimiter) { l.clock = clock }
+}
+
+// WithRateLimitByIP tells clients apart by IP address only, for limits applied before Authenticate
+func WithRateLimitByIP() RateLimiterOption {
+	return func(l *RateLimiter) { l.key = ipKey }
+}
+
+func NewRateLimiter(limit RateLimit, opts ...RateLimiterOption) *RateLimiter {
+	l := &RateLimiter{
+		limit:   limit.normalized(),
+		clock:   SystemClock,
+		key:     clientKey,
+		clients: make(map[string]*rateClient),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// SetLimit changes the limit of every client, buckets keep their tokens up to the new burst
+func (l *RateLimiter) SetLimit(limit RateLimit) {
+	limit = limit.normalized()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	l.limit = limit
+	for _, c := range l.clients {
+		c.limiter.SetLimitAt(now, rate.Limit(limit.Rate))
+		c.limiter.SetBurstAt(now, limit.Burst)
+	}
+}
+
+// Limit returns the current limit
+func (l *RateLimiter) Limit() RateLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// Middleware rejects requests over the limit with 429. Every response carries
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers.
+// Unless clients are told apart by IP address only, it must be used after Authenticate.
+func (l *RateLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := l.clock.Now()
+		limiter, limit := l.limiter(l.key(r), now)
+		if limit.Rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reservation := limiter.ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		if delay > 0 {
+			// The request is rejected, so it doesn't consume a token
+			reservation.CancelAt(now)
+		}
+
+		tokens := limiter.TokensAt(now)
+		header := w.Header()
+		header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		header.Set("RateLimit-Remaining", strconv.Itoa(max(0, int(tokens))))
+		header.Set("RateLimit-Reset", strconv.Itoa(limit.secondsUntilFull(tokens)))
+
+		if delay > 0 {
+			header.Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Seconds until the bucket is full again
+func (limit RateLimit) secondsUntilFull(tokens float64) int {
+	missing := float64(limit.Burst) - tokens
+	if missing <= 0 || limit.Rate <= 0 {
+		return 0
+	}
+	return int(math.Ceil(missing / limit.Rate))
+}
+
+// Bucket of the client along with the limit it was checked against
+func (l *RateLimiter) limiter(key string, now time.Time) (*rate.Limiter, RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bucket idle long enough to refill is the same as a new one, so it can be dropped
+	if now.Sub(l.lastSweep) >= rateLimitSweepInterval {
+		idle := rateLimitSweepInterval
+		if l.limit.Rate > 0 {
+			idle = max(idle, time.Duration(float64(l.limit.Burst)/l.limit.Rate*float64(time.Second)))
+		}
+		for k, c := range l.clients {
+			if now.Sub(c.lastSeen) > idle {
+				delete(l.clients, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	c, ok := l.clients[key]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(rate.Limit(l.limit.Rate), l.limit.Burst)}
+		l.clients[key] = c
+	}
+	c.lastSeen = now
+	return c.limiter, l.limit
+}
+
+// Key the client is throttled by
+func clientKey(r *http.Request) string {
+	if principal := PrincipalFromContext(r.Context()); principal != nil {
+		sum := sha256.Sum256([]byte(principal.Token))
+		return "token:" + hex.EncodeToString(sum[:])
+	}
+	return ipKey(r)
+}
+
+func ipKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,128 @@
+package library_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/mock"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)}
+	read := library.NewRateLimiter(library.RateLimit{Rate: 1, Burst: 2}, library.WithRateLimitClock(clock))
+	write := library.NewRateLimiter(library.RateLimit{Rate: 1, Burst: 1}, library.WithRateLimitClock(clock))
+
+	router := chi.NewRouter()
+	library.NewHandler(router, mock.NewMockService(), mock.NewMockUserServiceClient(),
+		library.WithRateLimits(read, write)).Register()
+
+	do := func(method, addr, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/books/1", nil)
+		req.RemoteAddr = addr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The burst is spent, then the client has to wait
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rr := do(http.MethodGet, "192.0.2.1:1234", "")
+		if rr.Code != want {
+			t.Fatalf("request %d: want status %d, got %d", i, want, rr.Code)
+		}
+		if i == 1 && rr.Header().Get("RateLimit-Remaining") != "0" {
+			t.Errorf("want no requests remaining, got %q", rr.Header().Get("RateLimit-Remaining"))
+		}
+		if want == http.StatusTooManyRequests && rr.Header().Get("Retry-After") != "1" {
+			t.Errorf("want Retry-After 1, got %q", rr.Header().Get("Retry-After"))
+		}
+	}
+
+	// Other clients and other routes have their own buckets
+	if rr := do(http.MethodGet, "192.0.2.2:1234", ""); rr.Code != http.StatusOK {
+		t.Errorf("other address: want status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := do(http.MethodGet, "192.0.2.1:1234", "token"); rr.Code != http.StatusOK {
+		t.Errorf("token: want status %d, got %d", http.StatusOK, rr.Code)
+	}
+	if rr := do(http.MethodDelete, "192.0.2.1:1234", "token"); rr.Code != http.StatusNoContent {
+		t.Errorf("write: want status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if rr := do(http.MethodDelete, "192.0.2.1:1234", "token"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("write: want status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	// Buckets refill over time
+	clock.now = clock.now.Add(time.Second)
+	if rr := do(http.MethodGet, "192.0.2.1:1234", ""); rr.Code != http.StatusOK {
+		t.Errorf("after refill: want status %d, got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestRateLimiter_SetLimit(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)}
+	limiter := library.NewRateLimiter(library.RateLimit{}, library.WithRateLimitClock(clock))
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/books", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// A zero rate lets everything through
+	for i := 0; i < 3; i++ {
+		if rr := do(); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "" {
+			t.Fatalf("disabled: want status %d without headers, got %d %v", http.StatusOK, rr.Code, rr.Header())
+		}
+	}
+
+	// Known clients are throttled by the new limit at once
+	limiter.SetLimit(library.RateLimit{Rate: 1})
+	if rr := do(); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("want status %d with limit 1, got %d %q", http.StatusOK, rr.Code, rr.Header().Get("RateLimit-Limit"))
+	}
+	if rr := do(); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("want status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestRateLimiter_byIP(t *testing.T) {
+	clock := &fixedClock{now: time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)}
+	users := &countingUserService{}
+	ip := library.NewRateLimiter(library.RateLimit{Rate: 1, Burst: 2}, library.WithRateLimitClock(clock), library.WithRateLimitByIP())
+
+	router := chi.NewRouter()
+	library.NewHandler(router, mock.NewMockService(), users, library.WithIPRateLimit(ip)).Register()
+
+	// Made up tokens of one address are throttled before they reach the user service
+	for i, token := range []string{"bad", "other", "another"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/books/1", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		want := http.StatusOK
+		switch i {
+		case 0:
+			want = http.StatusUnauthorized
+		case 2:
+			want = http.StatusTooManyRequests
+		}
+		if rr.Code != want {
+			t.Errorf("request %d: want status %d, got %d", i, want, rr.Code)
+		}
+	}
+	if calls := users.calls.Load(); calls != 2 {
+		t.Errorf("want 2 lookups, got %d", calls)
+	}
+}
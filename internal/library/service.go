@@ -2,60 +2,215 @@ package library
 
 import (
 	"context"
+	"log/slog"
 
+	"github.com/go-chi/chi/v5/middleware"
 	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
 	"github.com/pkg/errors"
 )
 
 type AppBookService struct {
 	store BookStore
+	audit AuditStore
 }
 
-func NewBookService(s BookStore) *AppBookService {
-	return &AppBookService{store: s}
+// ServiceOption configures AppBookService
+type ServiceOption func(*AppBookService)
+
+// WithAudit records every change of the catalogue in the audit log
+func WithAudit(audit AuditStore) ServiceOption {
+	return func(s *AppBookService) {
+		s.audit = audit
+	}
+}
+
+func NewBookService(s BookStore, opts ...ServiceOption) *AppBookService {
+	service := &AppBookService{store: s}
+	for _, opt := range opts {
+		opt(service)
+	}
+	return service
 }
 
-func (s *AppBookService) GetBooks(ctx context.Context, criteria string) ([]Book, error) {
-	// Fetch books from store (database)
-	books, err := s.store.LoadBooks(ctx, criteria)
+func (s *AppBookService) GetBooks(ctx context.Context, filter BookFilter) ([]Book, error) {
+	// Fetch books the caller may see from store (database)
+	filter.Visibility = visibleFor(ctx)
+	books, err := s.store.LoadBooks(ctx, filter)
 	if err != nil {
+		logStoreError(ctx, "LoadBooks", err)
 		return nil, errors.Wrap(err, oops.ErrLoadBooks.Error())
 	}
 	return books, nil
 }
 
+func (s *AppBookService) StreamBooks(ctx context.Context, filter BookFilter, fn func(Book) error) error {
+	// Pass books the caller may see from the store one by one
+	filter.Visibility = visibleFor(ctx)
+	err := s.store.IterateBooks(ctx, filter, fn)
+	if err != nil {
+		logStoreError(ctx, "IterateBooks", err)
+		return errors.Wrap(err, oops.ErrLoadBooks.Error())
+	}
+	return nil
+}
+
 func (s *AppBookService) CreateBook(ctx context.Context, book Book) (string, error) {
+	// Reject malformed books before they reach the store
+	book.ISBN = NormalizeISBN(book.ISBN)
+	if book.Visibility == "" {
+		book.Visibility = VisibilityPublic
+	}
+	if err := book.Validate(); err != nil {
+		return "", err
+	}
+
 	// Save book in the store (database)
-	id, err := s.store.SaveBook(ctx, book)
+	var id string
+	err := s.change(ctx, book.ID, AuditCreate, func(ctx context.Context, store BookStore) error {
+		var err error
+		id, err = store.SaveBook(ctx, book)
+		return storeError(ctx, "SaveBook", err)
+	})
 	if err != nil {
 		return "", errors.Wrap(err, oops.ErrCreateBook.Error())
 	}
+	LoggerFromContext(ctx).Info("book created", "book_id", id)
 	return id, nil
 }
 
 func (s *AppBookService) GetBookByID(ctx context.Context, id string) (*Book, error) {
-	// Fetch a single book by ID
-	book, err := s.store.LoadBookByID(ctx, id)
+	// Fetch a single book by ID, books the caller may not see don't exist for them
+	book, err := s.store.LoadBookByID(ctx, id, visibleFor(ctx)...)
+	if err != nil {
+		logStoreError(ctx, "LoadBookByID", err)
+		return nil, errors.Wrap(err, oops.ErrLoadBooks.Error())
+	}
+	return book, nil
+}
+
+func (s *AppBookService) GetBookByISBN(ctx context.Context, isbn string) (*Book, error) {
+	// Fetch a single book by its normalized ISBN
+	book, err := s.store.LoadBookByISBN(ctx, NormalizeISBN(isbn), visibleFor(ctx)...)
 	if err != nil {
+		logStoreError(ctx, "LoadBookByISBN", err)
 		return nil, errors.Wrap(err, oops.ErrLoadBooks.Error())
 	}
 	return book, nil
 }
 
 func (s *AppBookService) UpdateBook(ctx context.Context, id string, book Book) error {
+	// The book is identified by the given id, not by the body
+	book.ID = id
+	book.ISBN = NormalizeISBN(book.ISBN)
+	if err := book.Validate(); err != nil {
+		return err
+	}
+
 	// Update the book in the store
-	err := s.store.UpdateBook(ctx, id, book)
+	err := s.change(ctx, id, AuditUpdate, func(ctx context.Context, store BookStore) error {
+		return storeError(ctx, "UpdateBook", store.UpdateBook(ctx, id, book))
+	})
 	if err != nil {
 		return errors.Wrap(err, oops.ErrUpdateBook.Error())
 	}
+	LoggerFromContext(ctx).Info("book updated", "book_id", id)
 	return nil
 }
 
 func (s *AppBookService) DeleteBook(ctx context.Context, id string) error {
 	// Delete book from the store
-	err := s.store.DeleteBook(ctx, id)
+	err := s.change(ctx, id, AuditDelete, func(ctx context.Context, store BookStore) error {
+		return storeError(ctx, "DeleteBook", store.DeleteBook(ctx, id))
+	})
 	if err != nil {
 		return errors.Wrap(err, oops.ErrDeleteBook.Error())
 	}
+	LoggerFromContext(ctx).Info("book deleted", "book_id", id)
 	return nil
 }
+
+func (s *AppBookService) GetAudit(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	if s.audit == nil {
+		return nil, oops.ErrAuditDisabled
+	}
+	entries, err := s.audit.LoadAudit(ctx, filter)
+	if err != nil {
+		return nil, errors.Wrap(err, oops.ErrAudit.Error())
+	}
+	return entries, nil
+}
+
+func (s *AppBookService) VerifyAudit(ctx context.Context) (AuditVerification, error) {
+	if s.audit == nil {
+		return AuditVerification{}, oops.ErrAuditDisabled
+	}
+	result, err := VerifyAuditChain(ctx, s.audit)
+	if err != nil {
+		return result, errors.Wrap(err, oops.ErrAudit.Error())
+	}
+	return result, nil
+}
+
+// Apply the change of the book. When the catalogue is audited, the change is applied together with
+// its audit entry, the book being read before and after it within the same transaction.
+func (s *AppBookService) change(ctx context.Context, id string, action AuditAction, apply func(context.Context, BookStore) error) error {
+	if s.audit == nil {
+		return apply(ctx, s.store)
+	}
+
+	var changeErr error
+	_, err := s.audit.AuditChange(ctx, func(ctx context.Context, store BookStore) (AuditEntry, error) {
+		entry := AuditEntry{Action: action, BookID: id, RequestID: middleware.GetReqID(ctx)}
+		if principal := PrincipalFromContext(ctx); principal != nil {
+			entry.Actor = principal.UserID
+		}
+
+		if entry.Before, changeErr = storedBook(ctx, store, id); changeErr != nil {
+			return entry, changeErr
+		}
+		if changeErr = apply(ctx, store); changeErr != nil {
+			return entry, changeErr
+		}
+		if entry.After, changeErr = storedBook(ctx, store, id); changeErr != nil {
+			return entry, changeErr
+		}
+
+		if action == AuditUpdate && entry.Before != nil && entry.After != nil {
+			entry.Action = updateAction(*entry.Before, *entry.After)
+		}
+		return entry, nil
+	})
+	if err != nil && changeErr == nil {
+		// Nothing is stored when the entry can't be
+		logStoreError(ctx, "AuditChange", err)
+		return errors.Wrap(err, oops.ErrAudit.Error())
+	}
+	return err
+}
+
+// State of the book as stored, nil when it doesn't exist
+func storedBook(ctx context.Context, store BookStore, id string) (*Book, error) {
+	book, err := store.LoadBookByID(ctx, id)
+	if errors.Is(err, oops.ErrUnexistedBook) {
+		return nil, nil
+	}
+	return book, storeError(ctx, "LoadBookByID", err)
+}
+
+// Log the error of the store call, if any, and pass it on
+func storeError(ctx context.Context, operation string, err error) error {
+	if err != nil {
+		logStoreError(ctx, operation, err)
+	}
+	return err
+}
+
+// Log a failed store call with the request attributes. Missing and duplicate books are
+// the caller's mistake rather than a failure of the service, so they are only debug records.
+func logStoreError(ctx context.Context, operation string, err error) {
+	level := slog.LevelError
+	if errors.Is(err, oops.ErrUnexistedBook) || errors.Is(err, oops.ErrDuplicateID) {
+		level = slog.LevelDebug
+	}
+	LoggerFromContext(ctx).Log(ctx, level, "store operation failed", "operation", operation, "error", err)
+}
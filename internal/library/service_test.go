@@ -2,14 +2,26 @@ package library_test
 
 import (
 	"context"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
 	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
 )
 
+// Clock frozen at a single moment
+type fixedClock struct {
+	now time.Time
+}
+
+func (c fixedClock) Now() time.Time {
+	return c.now
+}
+
 func TestBookService(t *testing.T) {
-	bookStore := memory.NewMemoryBookStore()
+	now := time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)
+	bookStore := memory.NewMemoryBookStore(memory.WithClock(fixedClock{now: now}))
 	bookService := library.NewBookService(bookStore)
 
 	// Test 1: Add a new book
@@ -33,6 +45,9 @@ func TestBookService(t *testing.T) {
 		if err != nil {
 			t.Errorf("LoadBookByID failed: %s", err)
 		}
+		// Timestamps and the default visibility are set by the store
+		book.CreatedAt, book.UpdatedAt = now, now
+		book.Visibility = library.VisibilityPublic
 		if book != *savedBook {
 			t.Errorf("LoadBookByID failed: expected %+v but got %+v", book, *savedBook)
 		}
@@ -57,6 +72,8 @@ func TestBookService(t *testing.T) {
 			t.Errorf("Failed to get book with id %s: %s", "2", err)
 		}
 
+		book.CreatedAt, book.UpdatedAt = now, now
+		book.Visibility = library.VisibilityPublic
 		if book != *fetchedBook {
 			t.Errorf("Failed to get book by id %s after creation", book.ID)
 		}
@@ -88,7 +105,7 @@ func TestBookService(t *testing.T) {
 			t.Errorf("Failed create book with id %s: %s", book2.ID, err)
 		}
 
-		books, err := bookService.GetBooks(context.Background(), "C++")
+		books, err := bookService.GetBooks(context.Background(), library.BookFilter{Criteria: "C++"})
 		if err != nil {
 			t.Errorf("Failed to find out the book with criteria %s: %s", "C++", err)
 		}
@@ -96,7 +113,7 @@ func TestBookService(t *testing.T) {
 			t.Errorf("Wrong GetBooks answer")
 		}
 
-		books, err = bookService.GetBooks(context.Background(), "Advanced")
+		books, err = bookService.GetBooks(context.Background(), library.BookFilter{Criteria: "Advanced"})
 		if err != nil {
 			t.Errorf("Failed to find out the book with criteria %s: %s", "Advanced", err)
 		}
@@ -130,6 +147,8 @@ func TestBookService(t *testing.T) {
 			t.Errorf("Couldn't find the book with id %s after update: %s", book.ID, err)
 		}
 
+		updatedBook.CreatedAt, updatedBook.UpdatedAt = now, now
+		updatedBook.Visibility = library.VisibilityPublic
 		if updatedBook != *updatedBookFromStore {
 			t.Errorf("Failed update the book")
 		}
@@ -157,5 +176,77 @@ func TestBookService(t *testing.T) {
 		if err == nil {
 			t.Errorf("Book with id %s was not deleted", book.ID)
 		}
+
+		// The tombstone is still visible to incremental sync
+		books, err := bookService.GetBooks(context.Background(), library.BookFilter{UpdatedSince: now, IncludeDeleted: true})
+		if err != nil {
+			t.Errorf("Failed to get books changed since %s: %s", now, err)
+		}
+		deleted := 0
+		for _, b := range books {
+			if b.DeletedAt != nil {
+				deleted++
+				if b.ID != book.ID || !b.DeletedAt.Equal(now) {
+					t.Errorf("Wrong tombstone %+v", b)
+				}
+			}
+		}
+		if deleted != 1 {
+			t.Errorf("Expected a single tombstone, got %d", deleted)
+		}
+
+		// The id may be used again
+		if _, err := bookService.CreateBook(context.Background(), book); err != nil {
+			t.Errorf("Couldn't create book with id %s after deletion: %s", book.ID, err)
+		}
 	})
 }
+
+func TestBookService_visibility(t *testing.T) {
+	store := memory.NewMemoryBookStore()
+	service := library.NewBookService(store)
+
+	books := []library.Book{
+		{ID: "1", Title: "Go Programming"},
+		{ID: "2", Title: "Go Internals", Visibility: library.VisibilityStaff},
+		{ID: "3", Title: "Go Roadmap", Visibility: library.VisibilityHidden},
+	}
+	for _, book := range books {
+		if _, err := service.CreateBook(library.WithSystemAccess(context.Background()), book); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want []string
+	}{
+		{"anonymous", context.Background(), []string{"1"}},
+		{"staff", library.WithPrincipal(context.Background(), library.NewPrincipal("1", "token", library.PermQueryTotalStock)), []string{"1", "2"}},
+		{"manager", library.WithPrincipal(context.Background(), library.NewPrincipal("2", "token", library.PermManageBooks)), []string{"1", "2", "3"}},
+		{"system", library.WithSystemAccess(context.Background()), []string{"1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := service.GetBooks(tt.ctx, library.BookFilter{Criteria: "Go"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, book := range found {
+				ids = append(ids, book.ID)
+			}
+			if !slices.Equal(ids, tt.want) {
+				t.Errorf("GetBooks: want %v, got %v", tt.want, ids)
+			}
+
+			for _, book := range books {
+				_, err := service.GetBookByID(tt.ctx, book.ID)
+				if visible := slices.Contains(tt.want, book.ID); visible != (err == nil) {
+					t.Errorf("GetBookByID(%s): want visible %v, got error %v", book.ID, visible, err)
+				}
+			}
+		})
+	}
+}
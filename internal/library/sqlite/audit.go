@@ -0,0 +1,167 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+// Columns of the audit_log table in the order scanAuditEntry expects them
+const auditColumns = `seq, time, actor, action, book_id, before, after, request_id, prev_hash, hash`
+
+func scanAuditEntry(row scanner) (library.AuditEntry, error) {
+	var entry library.AuditEntry
+	var at int64
+	var before, after sql.NullString
+	err := row.Scan(&entry.Seq, &at, &entry.Actor, &entry.Action, &entry.BookID, &before, &after, &entry.RequestID,
+		&entry.PrevHash, &entry.Hash)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Time = time.Unix(0, at).UTC()
+	if entry.Before, err = unmarshalSnapshot(before); err != nil {
+		return entry, err
+	}
+	if entry.After, err = unmarshalSnapshot(after); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+func (s *SQLiteBookStore) AuditChange(ctx context.Context, change library.BookChange) (library.AuditEntry, error) {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return library.AuditEntry{}, err
+	}
+	defer tx.Rollback()
+
+	entry, err := change(ctx, &SQLiteBookStore{db: s.db, clock: s.clock, books: tx})
+	if err != nil {
+		return entry, err
+	}
+
+	var prevSeq int64
+	var prevHash string
+	err = tx.QueryRowContext(ctx, `SELECT seq, hash FROM audit_log ORDER BY seq DESC LIMIT 1`).Scan(&prevSeq, &prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return entry, err
+	}
+
+	now := s.now()
+	entry.Seq = prevSeq + 1
+	entry.Time = time.Unix(0, now).UTC()
+	if err := library.SealAuditEntry(&entry, prevHash); err != nil {
+		return entry, err
+	}
+
+	before, err := marshalSnapshot(entry.Before)
+	if err != nil {
+		return entry, err
+	}
+	after, err := marshalSnapshot(entry.After)
+	if err != nil {
+		return entry, err
+	}
+
+	query := `INSERT INTO audit_log (` + auditColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = tx.ExecContext(ctx, query, entry.Seq, now, entry.Actor, entry.Action, entry.BookID, before, after, entry.RequestID,
+		entry.PrevHash, entry.Hash)
+	if err != nil {
+		return entry, err
+	}
+	if err := tx.Commit(); err != nil {
+		return entry, err
+	}
+
+	library.LoggerFromContext(ctx).Debug("appended audit entry", "seq", entry.Seq, "hash", entry.Hash)
+	return entry, nil
+}
+
+func (s *SQLiteBookStore) LoadAudit(ctx context.Context, filter library.AuditFilter) ([]library.AuditEntry, error) {
+	conditions := []string{`seq > ?`}
+	args := []any{filter.AfterSeq}
+	if filter.Actor != "" {
+		conditions = append(conditions, `actor = ?`)
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, `action = ?`)
+		args = append(args, filter.Action)
+	}
+	if filter.BookID != "" {
+		conditions = append(conditions, `book_id = ?`)
+		args = append(args, filter.BookID)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, `time >= ?`)
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, `time < ?`)
+		args = append(args, filter.Until.UnixNano())
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM audit_log WHERE ` + strings.Join(conditions, " AND ") + ` ORDER BY seq`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	var entries []library.AuditEntry
+	err := s.iterateAudit(ctx, query, args, func(entry library.AuditEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func (s *SQLiteBookStore) IterateAudit(ctx context.Context, fn func(library.AuditEntry) error) error {
+	return s.iterateAudit(ctx, `SELECT `+auditColumns+` FROM audit_log ORDER BY seq`, nil, fn)
+}
+
+func (s *SQLiteBookStore) iterateAudit(ctx context.Context, query string, args []any, fn func(library.AuditEntry) error) error {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanAuditEntry(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func marshalSnapshot(book *library.Book) (sql.NullString, error) {
+	if book == nil {
+		return sql.NullString{}, nil
+	}
+	data, err := json.Marshal(book)
+	return sql.NullString{String: string(data), Valid: true}, err
+}
+
+func unmarshalSnapshot(data sql.NullString) (*library.Book, error) {
+	if !data.Valid {
+		return nil, nil
+	}
+	var book library.Book
+	if err := json.Unmarshal([]byte(data.String), &book); err != nil {
+		return nil, err
+	}
+	return &book, nil
+}
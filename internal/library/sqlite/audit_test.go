@@ -0,0 +1,75 @@
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/sqlite"
+)
+
+// Snapshots and timestamps must come back from the table exactly as they were hashed
+func TestSQLiteBookStore_audit(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSQLiteBookStore(filepath.Join(t.TempDir(), "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := library.NewBookService(store, library.WithAudit(store))
+
+	book := library.Book{ID: "1", Title: "Go Programming", Author: "Alan Donovan", Stock: "3"}
+	if _, err := service.CreateBook(ctx, book); err != nil {
+		t.Fatal(err)
+	}
+	book.Stock = "2"
+	if err := service.UpdateBook(ctx, "1", book); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.DeleteBook(ctx, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := service.VerifyAudit(ctx)
+	if err != nil || !result.OK || result.Checked != 3 {
+		t.Errorf("want intact chain of 3 entries, got %+v (%v)", result, err)
+	}
+
+	entries, err := service.GetAudit(ctx, library.AuditFilter{AfterSeq: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Action != library.AuditStock || entries[0].Before.Stock != "3" || entries[0].After.Stock != "2" {
+		t.Errorf("wrong entries %+v", entries)
+	}
+}
+
+func TestSQLiteBookStore_AuditChange_rollback(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSQLiteBookStore(filepath.Join(t.TempDir(), "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SaveBook(ctx, library.Book{ID: "1", Title: "Go Programming"}); err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("no entry")
+	_, err = store.AuditChange(ctx, func(ctx context.Context, books library.BookStore) (library.AuditEntry, error) {
+		if err := books.UpdateBook(ctx, "1", library.Book{Title: "The Go Programming Language"}); err != nil {
+			return library.AuditEntry{}, err
+		}
+		return library.AuditEntry{}, failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("want %v, got %v", failure, err)
+	}
+
+	if book, err := store.LoadBookByID(ctx, "1"); err != nil || book.Title != "Go Programming" {
+		t.Errorf("want the change rolled back, got %+v, %v", book, err)
+	}
+	if entries, _ := store.LoadAudit(ctx, library.AuditFilter{}); len(entries) != 0 {
+		t.Errorf("want no entry, got %+v", entries)
+	}
+}
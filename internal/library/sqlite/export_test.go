@@ -0,0 +1,10 @@
+package sqlite
+
+import "testing"
+
+// SetIteratePageSize changes the number of books IterateBooks reads per query until the test ends
+func SetIteratePageSize(t testing.TB, size int) {
+	previous := iteratePageSize
+	iteratePageSize = size
+	t.Cleanup(func() { iteratePageSize = previous })
+}
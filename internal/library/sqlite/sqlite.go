@@ -3,8 +3,13 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -13,42 +18,239 @@ import (
 	"github.com/pkg/errors"
 )
 
+// Schema migrations, applied in order. The index of the last applied
+// migration plus one is stored in PRAGMA user_version.
+var migrations = []string{
+	// Create the books table if it doesn't exist
+	`CREATE TABLE IF NOT EXISTS books (
+		id TEXT PRIMARY KEY,
+		title TEXT,
+		author TEXT,
+		description TEXT,
+		stock TEXT
+	);`,
+	`ALTER TABLE books ADD COLUMN isbn TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS books_isbn ON books (isbn) WHERE isbn <> '';`,
+	`ALTER TABLE books ADD COLUMN publisher TEXT NOT NULL DEFAULT '';
+	ALTER TABLE books ADD COLUMN year TEXT NOT NULL DEFAULT '';`,
+	// Modification time in Unix nanoseconds, books existing before are stamped with the migration time
+	`ALTER TABLE books ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE books SET updated_at = CAST((julianday('now') - 2440587.5) * 86400000 AS INTEGER) * 1000000;
+	CREATE INDEX IF NOT EXISTS books_updated_at ON books (updated_at);`,
+	// Deleted books are kept as tombstones with deleted_at set
+	`ALTER TABLE books ADD COLUMN created_at INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE books ADD COLUMN deleted_at INTEGER;
+	UPDATE books SET created_at = updated_at;`,
+	// Hash chained log of catalogue changes, books are stored as JSON snapshots
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		seq INTEGER PRIMARY KEY,
+		time INTEGER NOT NULL,
+		actor TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		book_id TEXT NOT NULL,
+		before TEXT,
+		after TEXT,
+		request_id TEXT NOT NULL DEFAULT '',
+		prev_hash TEXT NOT NULL,
+		hash TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_book_id ON audit_log (book_id);
+	CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);`,
+	`ALTER TABLE books ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public';
+	CREATE INDEX IF NOT EXISTS books_visibility ON books (visibility);`,
+}
+
+// Columns of the books table in the order scanBook expects them
+const bookColumns = `id, title, author, description, stock, isbn, publisher, year, visibility, created_at, updated_at, deleted_at`
+
+// Something holding a single row, either *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// Something running queries, either *sql.DB or *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func scanBook(row scanner) (library.Book, error) {
+	var book library.Book
+	var createdAt, updatedAt int64
+	var deletedAt sql.NullInt64
+	err := row.Scan(&book.ID, &book.Title, &book.Author, &book.Description, &book.Stock, &book.ISBN, &book.Publisher, &book.Year,
+		&book.Visibility, &createdAt, &updatedAt, &deletedAt)
+	book.CreatedAt = time.Unix(0, createdAt).UTC()
+	book.UpdatedAt = time.Unix(0, updatedAt).UTC()
+	if deletedAt.Valid {
+		t := time.Unix(0, deletedAt.Int64).UTC()
+		book.DeletedAt = &t
+	}
+	return book, err
+}
+
 type SQLiteBookStore struct {
-	db *sql.DB
+	db    *sql.DB
+	clock library.Clock
+	// Runs the queries of books: the pool itself, or the transaction of an audited change
+	books querier
+
+	// Connection settings, applied when the database is opened
+	wal          bool
+	busyTimeout  time.Duration
+	maxOpenConns int
+
+	// Audited changes are serialized to keep the hash chain linear
+	auditMu sync.Mutex
+
+	// Writes are probed at most once per writeCheckInterval, the probe takes the write lock
+	writeCheckMu sync.Mutex
+	writableAt   time.Time
+}
+
+// How long a successful write probe of Check is trusted
+const writeCheckInterval = time.Minute
+
+// Option configures SQLiteBookStore
+type Option func(*SQLiteBookStore)
+
+// WithClock makes the store stamp changes with the given clock
+func WithClock(clock library.Clock) Option {
+	return func(s *SQLiteBookStore) {
+		s.clock = clock
+	}
+}
+
+// WithWAL switches the database to write-ahead logging, so that readers don't wait for writers
+func WithWAL(wal bool) Option {
+	return func(s *SQLiteBookStore) {
+		s.wal = wal
+	}
 }
 
-func NewSQLiteBookStore(path string) (*SQLiteBookStore, error) {
-	dir := filepath.Dir(path)
+// WithBusyTimeout makes statements wait that long for a locked database instead of failing at once
+func WithBusyTimeout(timeout time.Duration) Option {
+	return func(s *SQLiteBookStore) {
+		s.busyTimeout = timeout
+	}
+}
+
+// WithMaxOpenConns limits the connection pool, zero means no limit
+func WithMaxOpenConns(n int) Option {
+	return func(s *SQLiteBookStore) {
+		s.maxOpenConns = n
+	}
+}
+
+func NewSQLiteBookStore(path string, opts ...Option) (*SQLiteBookStore, error) {
+	s := &SQLiteBookStore{clock: library.SystemClock}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	file, _, _ := strings.Cut(path, "?")
+	dir := filepath.Dir(file)
 	err := os.MkdirAll(dir, os.ModePerm)
 	if err != nil {
 		return nil, errors.Wrap(err, oops.ErrOSMkdir.Error())
 	}
 
-	db, err := sql.Open("sqlite3", path)
+	db, err := sql.Open("sqlite3", s.dsn(path))
 	if err != nil {
 		return nil, err
 	}
+	db.SetMaxOpenConns(s.maxOpenConns)
 
-	// Create the books table if it doesn't exist
-	create := `CREATE TABLE IF NOT EXISTS books (
-		id TEXT PRIMARY KEY,
-		title TEXT,
-		author TEXT,
-		description TEXT,
-		stock TEXT
-	);`
+	// Bring the schema up to date
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, oops.ErrMigration.Error())
+	}
 
-	_, err = db.Exec(create)
-	if err != nil {
-		return nil, errors.Wrap(err, oops.ErrCreatingTable.Error())
+	s.db, s.books = db, db
+	return s, nil
+}
+
+// Connection settings are passed to the driver in the DSN, so that every connection of the pool gets them
+func (s *SQLiteBookStore) dsn(path string) string {
+	// Transactions take the write lock up front, so that a change reading a book
+	// before writing it can't fail to upgrade its lock half way
+	params := []string{"_txlock=immediate"}
+	if s.wal {
+		params = append(params, "_journal_mode=WAL")
+	}
+	if s.busyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", s.busyTimeout.Milliseconds()))
+	}
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
 	}
+	return path + separator + strings.Join(params, "&")
+}
 
-	return &SQLiteBookStore{db: db}, nil
+// Close waits for the queries in progress and closes the database
+func (s *SQLiteBookStore) Close() error {
+	return s.db.Close()
 }
 
-func (s *SQLiteBookStore) LoadBooks(ctx context.Context, criteria string) ([]library.Book, error) {
-	query := `SELECT id, title, author, description, stock FROM books WHERE title LIKE ? OR author LIKE ? OR description LIKE ?`
-	rows, err := s.db.QueryContext(ctx, query, "%"+criteria+"%", "%"+criteria+"%", "%"+criteria+"%")
+// DB is the underlying connection pool, e.g. for its statistics
+func (s *SQLiteBookStore) DB() *sql.DB {
+	return s.db
+}
+
+func (s *SQLiteBookStore) LoadBooks(ctx context.Context, filter library.BookFilter) ([]library.Book, error) {
+	return s.queryBooks(ctx, filter)
+}
+
+// Books read by a query of IterateBooks. Each page is read whole and its rows closed before fn
+// sees the books, so a slow consumer, e.g. a client downloading an export, doesn't hold a read
+// transaction blocking the writers.
+var iteratePageSize = 500
+
+// IterateBooks pages through the books by ID. Changes made between pages show up in later ones,
+// but no book is seen twice or skipped unless it is changed.
+func (s *SQLiteBookStore) IterateBooks(ctx context.Context, filter library.BookFilter, fn func(library.Book) error) error {
+	remaining := filter.Limit
+	for {
+		page := filter
+		page.Limit = iteratePageSize
+		if remaining > 0 && remaining < page.Limit {
+			page.Limit = remaining
+		}
+		books, err := s.queryBooks(ctx, page)
+		if err != nil {
+			return err
+		}
+
+		for _, book := range books {
+			if err := fn(book); err != nil {
+				return err
+			}
+		}
+		if len(books) < page.Limit {
+			return nil
+		}
+		if remaining > 0 {
+			if remaining -= len(books); remaining == 0 {
+				return nil
+			}
+		}
+		filter.AfterID = books[len(books)-1].ID
+	}
+}
+
+// Read the matching books with a single query
+func (s *SQLiteBookStore) queryBooks(ctx context.Context, filter library.BookFilter) ([]library.Book, error) {
+	where, args := filterClause(filter)
+	query := `SELECT ` + bookColumns + ` FROM books WHERE ` + where + ` ORDER BY id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+	start := time.Now()
+	rows, err := s.books.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -56,27 +258,46 @@ func (s *SQLiteBookStore) LoadBooks(ctx context.Context, criteria string) ([]lib
 
 	var books []library.Book
 	for rows.Next() {
-		var book library.Book
-		err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.Description, &book.Stock)
+		book, err := scanBook(rows)
 		if err != nil {
 			return nil, err
 		}
 		books = append(books, book)
 	}
-
 	if err := rows.Err(); err != nil {
 		return nil, err
 	}
 
+	library.LoggerFromContext(ctx).Debug("queried books", "where", where, "rows", len(books), "latency", time.Since(start))
 	return books, nil
 }
 
-func (s *SQLiteBookStore) LoadBookByID(ctx context.Context, id string) (*library.Book, error) {
-	query := `SELECT id, title, author, description, stock FROM books WHERE id = ?`
-	row := s.db.QueryRowContext(ctx, query, id)
+func (s *SQLiteBookStore) LoadBookByID(ctx context.Context, id string, visibility ...library.Visibility) (*library.Book, error) {
+	cond, args := visibilityClause(visibility)
+	query := `SELECT ` + bookColumns + ` FROM books WHERE id = ? AND deleted_at IS NULL AND ` + cond
+	row := s.books.QueryRowContext(ctx, query, append([]any{id}, args...)...)
 
-	var book library.Book
-	err := row.Scan(&book.ID, &book.Title, &book.Author, &book.Description, &book.Stock)
+	book, err := scanBook(row)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, oops.ErrUnexistedBook
+		}
+		return nil, err
+	}
+
+	return &book, nil
+}
+
+func (s *SQLiteBookStore) LoadBookByISBN(ctx context.Context, isbn string, visibility ...library.Visibility) (*library.Book, error) {
+	if isbn == "" {
+		return nil, oops.ErrUnexistedBook
+	}
+
+	cond, args := visibilityClause(visibility)
+	query := `SELECT ` + bookColumns + ` FROM books WHERE isbn = ? AND deleted_at IS NULL AND ` + cond + ` LIMIT 1`
+	row := s.books.QueryRowContext(ctx, query, append([]any{isbn}, args...)...)
+
+	book, err := scanBook(row)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, oops.ErrUnexistedBook
@@ -88,18 +309,42 @@ func (s *SQLiteBookStore) LoadBookByID(ctx context.Context, id string) (*library
 }
 
 func (s *SQLiteBookStore) SaveBook(ctx context.Context, book library.Book) (string, error) {
-	query := `INSERT INTO books (id, title, author, description, stock) VALUES (?, ?, ?, ?, ?)`
-	_, err := s.db.ExecContext(ctx, query, book.ID, book.Title, book.Author, book.Description, book.Stock)
+	// Tombstones of deleted books may be replaced
+	query := `INSERT INTO books (` + bookColumns + `) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULL)
+		ON CONFLICT (id) DO UPDATE SET
+			title = excluded.title, author = excluded.author, description = excluded.description,
+			stock = excluded.stock, isbn = excluded.isbn, publisher = excluded.publisher, year = excluded.year,
+			visibility = excluded.visibility, created_at = excluded.created_at, updated_at = excluded.updated_at, deleted_at = NULL
+		WHERE books.deleted_at IS NOT NULL`
+	if book.Visibility == "" {
+		book.Visibility = library.VisibilityPublic
+	}
+	now := s.now()
+	result, err := s.books.ExecContext(ctx, query, book.ID, book.Title, book.Author, book.Description, book.Stock, book.ISBN, book.Publisher, book.Year,
+		book.Visibility, now, now)
 	if err != nil {
 		return "", err
 	}
 
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return "", err
+	}
+
+	if rowsAffected == 0 {
+		return "", oops.ErrDuplicateID
+	}
+
 	return book.ID, nil
 }
 
 func (s *SQLiteBookStore) UpdateBook(ctx context.Context, id string, book library.Book) error {
-	query := `UPDATE books SET title = ?, author = ?, description = ?, stock = ? WHERE id = ?`
-	result, err := s.db.ExecContext(ctx, query, book.Title, book.Author, book.Description, book.Stock, id)
+	// Visibility is only changed when given
+	query := `UPDATE books SET title = ?, author = ?, description = ?, stock = ?, isbn = ?, publisher = ?, year = ?,
+			visibility = COALESCE(NULLIF(?, ''), visibility), updated_at = ?
+		WHERE id = ? AND deleted_at IS NULL`
+	result, err := s.books.ExecContext(ctx, query, book.Title, book.Author, book.Description, book.Stock, book.ISBN, book.Publisher, book.Year,
+		book.Visibility, s.now(), id)
 	if err != nil {
 		return err
 	}
@@ -117,8 +362,10 @@ func (s *SQLiteBookStore) UpdateBook(ctx context.Context, id string, book librar
 }
 
 func (s *SQLiteBookStore) DeleteBook(ctx context.Context, id string) error {
-	query := `DELETE FROM books WHERE id = ?`
-	result, err := s.db.ExecContext(ctx, query, id)
+	// Keep a tombstone so that harvesters learn about the deletion
+	query := `UPDATE books SET updated_at = ?, deleted_at = ? WHERE id = ? AND deleted_at IS NULL`
+	now := s.now()
+	result, err := s.books.ExecContext(ctx, query, now, now, id)
 	if err != nil {
 		return err
 	}
@@ -134,3 +381,141 @@ func (s *SQLiteBookStore) DeleteBook(ctx context.Context, id string) error {
 
 	return nil
 }
+
+func (s *SQLiteBookStore) CountBooks(ctx context.Context) (library.CatalogueCount, error) {
+	// Stock is validated on the way in, an empty one casts to 0
+	query := `SELECT visibility, COUNT(*), COALESCE(SUM(CAST(stock AS INTEGER)), 0) FROM books
+		WHERE deleted_at IS NULL GROUP BY visibility`
+	rows, err := s.books.QueryContext(ctx, query)
+	if err != nil {
+		return library.CatalogueCount{}, err
+	}
+	defer rows.Close()
+
+	count := library.CatalogueCount{Books: make(map[library.Visibility]int)}
+	for rows.Next() {
+		var visibility library.Visibility
+		var books, stock int
+		if err := rows.Scan(&visibility, &books, &stock); err != nil {
+			return library.CatalogueCount{}, err
+		}
+		count.Books[visibility] = books
+		count.Stock += stock
+	}
+	return count, rows.Err()
+}
+
+// Check reports whether the database answers, has every migration applied and accepts writes.
+// Writes are probed again only once the last successful probe is a minute old, failed ones every time.
+func (s *SQLiteBookStore) Check(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var version int
+	if err := conn.QueryRowContext(ctx, `PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version < len(migrations) {
+		return errors.Wrapf(oops.ErrMigration, "%d of %d migrations applied", version, len(migrations))
+	}
+
+	s.writeCheckMu.Lock()
+	defer s.writeCheckMu.Unlock()
+	if !s.writableAt.IsZero() && s.clock.Now().Sub(s.writableAt) < writeCheckInterval {
+		return nil
+	}
+
+	// Rewrite the header with the same value and roll back: only a write finds out
+	// about read-only files, the write lock alone is granted to them
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		return err
+	}
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(`PRAGMA user_version = %d`, version))
+	if _, rollbackErr := conn.ExecContext(ctx, `ROLLBACK`); err == nil {
+		err = rollbackErr
+	}
+	if err == nil {
+		s.writableAt = s.clock.Now()
+	}
+	return err
+}
+
+// Current time in the form stored in the table
+func (s *SQLiteBookStore) now() int64 {
+	return s.clock.Now().UnixNano()
+}
+
+// Build the WHERE clause matching the filter
+func filterClause(filter library.BookFilter) (string, []any) {
+	like := "%" + filter.Criteria + "%"
+	conditions := []string{`(title LIKE ? OR author LIKE ? OR description LIKE ?)`}
+	args := []any{like, like, like}
+
+	if !filter.IncludeDeleted {
+		conditions = append(conditions, `deleted_at IS NULL`)
+	}
+	if !filter.UpdatedSince.IsZero() {
+		conditions = append(conditions, `updated_at >= ?`)
+		args = append(args, filter.UpdatedSince.UnixNano())
+	}
+	if !filter.UpdatedBefore.IsZero() {
+		conditions = append(conditions, `updated_at < ?`)
+		args = append(args, filter.UpdatedBefore.UnixNano())
+	}
+	if filter.AfterID != "" {
+		conditions = append(conditions, `id > ?`)
+		args = append(args, filter.AfterID)
+	}
+	if len(filter.Visibility) > 0 {
+		cond, visibilityArgs := visibilityClause(filter.Visibility)
+		conditions = append(conditions, cond)
+		args = append(args, visibilityArgs...)
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// Build the condition keeping books with one of the visibilities, any book passes an empty list
+func visibilityClause(visibility []library.Visibility) (string, []any) {
+	if len(visibility) == 0 {
+		return `1`, nil
+	}
+	args := make([]any, len(visibility))
+	for i, v := range visibility {
+		args[i] = string(v)
+	}
+	return `visibility IN (?` + strings.Repeat(`, ?`, len(visibility)-1) + `)`, args
+}
+
+// Apply migrations which are not yet recorded in user_version
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d", i+1)
+		}
+		// PRAGMA does not accept bound parameters
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		slog.Info("applied database migration", "version", i+1)
+	}
+
+	return nil
+}
@@ -0,0 +1,151 @@
+package sqlite_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/sqlite"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+)
+
+// Visibility is filtered by the queries themselves
+func TestSQLiteBookStore_visibility(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSQLiteBookStore(filepath.Join(t.TempDir(), "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, book := range []library.Book{
+		{ID: "1", Title: "Go Programming", ISBN: "9780134190440"},
+		{ID: "2", Title: "Go Roadmap", Visibility: library.VisibilityHidden},
+	} {
+		if _, err := store.SaveBook(ctx, book); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	books, err := store.LoadBooks(ctx, library.BookFilter{Visibility: []library.Visibility{library.VisibilityPublic, library.VisibilityStaff}})
+	if err != nil || len(books) != 1 || books[0].ID != "1" || books[0].Visibility != library.VisibilityPublic {
+		t.Errorf("want only the public book, got %+v (%v)", books, err)
+	}
+	if _, err := store.LoadBookByID(ctx, "2", library.VisibilityPublic); !errors.Is(err, oops.ErrUnexistedBook) {
+		t.Errorf("want hidden book not found, got %v", err)
+	}
+	if book, err := store.LoadBookByID(ctx, "2"); err != nil || book.Visibility != library.VisibilityHidden {
+		t.Errorf("want hidden book without a filter, got %+v (%v)", book, err)
+	}
+	if _, err := store.LoadBookByISBN(ctx, "9780134190440", library.VisibilityPublic); err != nil {
+		t.Errorf("want public book by ISBN, got %v", err)
+	}
+
+	// Updates without a visibility keep the stored one
+	if err := store.UpdateBook(ctx, "2", library.Book{ID: "2", Title: "Go Roadmap 2025"}); err != nil {
+		t.Fatal(err)
+	}
+	if book, err := store.LoadBookByID(ctx, "2"); err != nil || book.Visibility != library.VisibilityHidden {
+		t.Errorf("want visibility kept by update, got %+v (%v)", book, err)
+	}
+}
+
+func TestSQLiteBookStore_Check(t *testing.T) {
+	store, err := sqlite.NewSQLiteBookStore(filepath.Join(t.TempDir(), "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Check(context.Background()); err != nil {
+		t.Errorf("want migrated and writable database, got %v", err)
+	}
+
+	// A recent write probe is trusted, so a probe doesn't wait for the writer
+	conn, err := store.DB().Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ExecContext(context.Background(), `BEGIN IMMEDIATE`); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if err := store.Check(ctx); err != nil {
+		t.Errorf("want no write probe while a writer holds the lock, got %v", err)
+	}
+	cancel()
+	if _, err := conn.ExecContext(context.Background(), `ROLLBACK`); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	store.DB().Close()
+	if err := store.Check(context.Background()); err == nil {
+		t.Error("want closed database failing")
+	}
+}
+
+func TestSQLiteBookStore_CountBooks(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSQLiteBookStore(filepath.Join(t.TempDir(), "books.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, book := range []library.Book{
+		{ID: "1", Title: "Go Programming", Stock: "3"},
+		{ID: "2", Title: "Go Roadmap", Stock: "2", Visibility: library.VisibilityHidden},
+		{ID: "3", Title: "Go Basics"},
+		{ID: "4", Title: "Go Tombstone", Stock: "7"},
+	} {
+		if _, err := store.SaveBook(ctx, book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.DeleteBook(ctx, "4"); err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := store.CountBooks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count.Books[library.VisibilityPublic] != 2 || count.Books[library.VisibilityHidden] != 1 || count.Stock != 5 {
+		t.Errorf("want 2 public and 1 hidden book with 5 copies, got %+v", count)
+	}
+}
+
+// Books are read in pages, so writers aren't blocked while the caller consumes them
+func TestSQLiteBookStore_IterateBooks(t *testing.T) {
+	ctx := context.Background()
+	store, err := sqlite.NewSQLiteBookStore(filepath.Join(t.TempDir(), "books.db"), sqlite.WithBusyTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlite.SetIteratePageSize(t, 2)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		if _, err := store.SaveBook(ctx, library.Book{ID: id, Title: "Go Programming"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		limit int
+		want  string
+	}{
+		{0, "12345"},
+		{4, "1234"},
+		{3, "123"},
+	} {
+		var got string
+		err := store.IterateBooks(ctx, library.BookFilter{Limit: tc.limit}, func(book library.Book) error {
+			got += book.ID
+			// Without WAL an open cursor would keep the write waiting until the busy timeout
+			return store.UpdateBook(ctx, book.ID, library.Book{Title: "The Go Programming Language"})
+		})
+		if err != nil || got != tc.want {
+			t.Errorf("limit %d: want %s, got %s (%v)", tc.limit, tc.want, got, err)
+		}
+	}
+}
@@ -2,26 +2,183 @@ package library
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand/v2"
 	"net/http"
 	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the tracer of calls made by the library
+const tracerName = "github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+
+// Defaults of the user service client
+const (
+	DefaultUserTimeout    = 2 * time.Second
+	DefaultUserRetries    = 2
+	DefaultUserBackoff    = 100 * time.Millisecond
+	DefaultUserMaxBackoff = time.Second
 )
 
 type UserServiceClient struct {
 	BaseURL    string
 	HTTPClient *http.Client
+
+	// Timeout of a single attempt
+	Timeout time.Duration
+	// Number of attempts made after the first one failed
+	Retries int
+	// Bounds of the exponential backoff between attempts
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	breaker *breaker
+}
+
+// UserClientOption configures a UserServiceClient
+type UserClientOption func(*UserServiceClient)
+
+// WithUserTimeout sets the timeout of a single request to the user service
+func WithUserTimeout(timeout time.Duration) UserClientOption {
+	return func(c *UserServiceClient) { c.Timeout = timeout }
+}
+
+// WithUserRetries sets how many times a failed request is retried and the backoff bounds
+func WithUserRetries(retries int, backoff, maxBackoff time.Duration) UserClientOption {
+	return func(c *UserServiceClient) {
+		c.Retries = retries
+		c.Backoff = backoff
+		c.MaxBackoff = maxBackoff
+	}
+}
+
+// WithUserBreaker opens the circuit after threshold consecutive failures for cooldown,
+// a zero threshold disables the breaker
+func WithUserBreaker(threshold int, cooldown time.Duration, clock Clock) UserClientOption {
+	return func(c *UserServiceClient) { c.breaker = newBreaker(threshold, cooldown, clock) }
 }
 
-func NewUserServiceClient(baseURL string) *UserServiceClient {
-	return &UserServiceClient{
+func NewUserServiceClient(baseURL string, opts ...UserClientOption) *UserServiceClient {
+	client := &UserServiceClient{
 		BaseURL:    baseURL,
 		HTTPClient: &http.Client{},
+		Timeout:    DefaultUserTimeout,
+		Retries:    DefaultUserRetries,
+		Backoff:    DefaultUserBackoff,
+		MaxBackoff: DefaultUserMaxBackoff,
+		breaker:    newBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown, SystemClock),
+	}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client
+}
+
+// Resolve the token into its owner and the whole permission mask.
+// Rejected tokens yield oops.ErrInvalidToken, transport failures and 5xx replies oops.ErrUserServiceUnavailable.
+// Unavailability is retried with jittered exponential backoff, and fails fast while the circuit breaker is open.
+func (client *UserServiceClient) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		if ok, retryAfter := client.breaker.Allow(); !ok {
+			return nil, errors.Wrapf(oops.ErrUserServiceUnavailable, "circuit breaker is open, retry in %s", retryAfter.Round(time.Second))
+		}
+
+		var principal *Principal
+		principal, err = client.fetchPrincipal(ctx, token)
+		if !errors.Is(err, oops.ErrUserServiceUnavailable) {
+			// The service answered, even if it rejected the token
+			client.breaker.Success()
+			return principal, err
+		}
+		if ctx.Err() != nil {
+			// Our caller gave up, that says nothing about the service
+			return nil, err
+		}
+		client.breaker.Failure()
+
+		if attempt >= client.Retries {
+			return nil, err
+		}
+		LoggerFromContext(ctx).Warn("retrying user service", "attempt", attempt+1, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(client.backoff(attempt)):
+		}
+	}
+}
+
+// Ping checks that the user service answers at all, without retries and regardless of the circuit breaker.
+// Any reply below 500 counts, as there is no dedicated health endpoint.
+func (client *UserServiceClient) Ping(ctx context.Context) error {
+	if client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+client.BaseURL+"/", nil)
+	if err != nil {
+		return fmt.Errorf("error creating request to user service: %v", err)
 	}
+	resp, err := client.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Wrap(oops.ErrUserServiceUnavailable, err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return errors.Wrapf(oops.ErrUserServiceUnavailable, "status: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Full jitter: a random delay up to the exponentially growing bound
+func (client *UserServiceClient) backoff(attempt int) time.Duration {
+	bound := client.Backoff << attempt
+	if bound <= 0 || (client.MaxBackoff > 0 && bound > client.MaxBackoff) {
+		bound = client.MaxBackoff
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return rand.N(bound)
 }
 
-// Check if the token has the required permissions
-func (client *UserServiceClient) CheckPermissions(token string, mask uint) (bool, error) {
+// Make a single request for the permission mask
+func (client *UserServiceClient) fetchPrincipal(ctx context.Context, token string) (_ *Principal, err error) {
+	ctx, span := otel.Tracer(tracerName).Start(ctx, "POST /user/permissions",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPRequestMethodKey.String(http.MethodPost), semconv.ServerAddress(client.BaseURL)))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			if !errors.Is(err, oops.ErrInvalidToken) {
+				span.SetStatus(codes.Error, err.Error())
+			}
+		}
+		span.End()
+	}()
+
+	if client.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, client.Timeout)
+		defer cancel()
+	}
+
 	// Prepare the request body
 	data := struct {
 		Token string `json:"token"`
@@ -29,37 +186,58 @@ func (client *UserServiceClient) CheckPermissions(token string, mask uint) (bool
 
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return false, fmt.Errorf("error marshalling token data: %v", err)
+		return nil, fmt.Errorf("error marshalling token data: %v", err)
 	}
 
 	// Make the POST request to check permissions
-	resp, err := client.HTTPClient.Post("http://"+client.BaseURL+"/user/permissions", "application/json", bytes.NewReader(jsonData))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+client.BaseURL+"/user/permissions", bytes.NewReader(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request to user service: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// Let the user service tie its records to the request being served
+	if id := middleware.GetReqID(ctx); id != "" {
+		req.Header.Set(middleware.RequestIDHeader, id)
+	}
+	// Continue the trace in the user service
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := client.HTTPClient.Do(req)
 	if err != nil {
-		return false, fmt.Errorf("error sending request to user service: %v", err)
+		return nil, errors.Wrap(oops.ErrUserServiceUnavailable, err.Error())
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
 
-	if resp.StatusCode != http.StatusOK {
-		return false, fmt.Errorf("failed to check permissions, status: %d", resp.StatusCode)
+	switch {
+	case resp.StatusCode >= http.StatusInternalServerError, resp.StatusCode == http.StatusTooManyRequests:
+		return nil, errors.Wrapf(oops.ErrUserServiceUnavailable, "status: %d", resp.StatusCode)
+	case resp.StatusCode >= http.StatusBadRequest:
+		return nil, errors.Wrapf(oops.ErrInvalidToken, "status: %d", resp.StatusCode)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("failed to check permissions, status: %d", resp.StatusCode)
 	}
 
 	// Decode the response
 	var permissionResp struct {
+		UserID      string `json:"user_id"`
 		Permissions string `json:"permissios"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&permissionResp); err != nil {
-		return false, fmt.Errorf("error decoding permissions response: %v", err)
+		// Body cut short by the timeout is the service being slow, not malformed
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(oops.ErrUserServiceUnavailable, err.Error())
+		}
+		return nil, fmt.Errorf("error decoding permissions response: %v", err)
 	}
 
 	// Convert permissions string to an integer
-	// permissions, err := strconv.Atoi(permissionResp.Permissions)
 	permissions, err := strconv.ParseUint(permissionResp.Permissions, 10, 64)
 	if err != nil {
-		return false, fmt.Errorf("error converting permission value: %v", err)
+		return nil, fmt.Errorf("error converting permission value: %v", err)
 	}
 
-	// Check if the permission mask includes the required permission
-	return (uint(permissions)&mask != 0), nil
+	return NewPrincipal(permissionResp.UserID, token, uint(permissions)), nil
 }
 
 const (
@@ -68,7 +246,7 @@ const (
 	// PermQueryTotalStock allows the user to get the total stored book count
 	PermQueryTotalStock uint = 1 << 1
 	// PermChangeTotalStock allows the user to register updates to the total stored book count.
-	// Requires PermGetTotalStock as a prerequisite.
+	// Requires PermQueryTotalStock as a prerequisite.
 	PermChangeTotalStock uint = 1 << 2
 	// PermQueryUsers allows the user to get information about other users, including their permissions.
 	// Not required to get information about oneself, other rules apply.
@@ -88,3 +266,51 @@ const (
 	// PermQueryReservations allows the user to get information related to book reservations.
 	PermQueryReservations uint = 1 << 8
 )
+
+// Permissions that are only meaningful together with another one
+var permPrerequisites = map[uint]uint{
+	PermChangeTotalStock: PermQueryTotalStock,
+	PermManageUsers:      PermQueryUsers,
+	PermGrantPermissions: PermQueryUsers,
+}
+
+// WithPrerequisites adds the prerequisites of every permission in the mask
+func WithPrerequisites(mask uint) uint {
+	for perm, prerequisite := range permPrerequisites {
+		if mask&perm != 0 {
+			mask |= prerequisite
+		}
+	}
+	return mask
+}
+
+// EffectivePermissions drops the permissions whose prerequisites are missing from the mask
+func EffectivePermissions(mask uint) uint {
+	for perm, prerequisite := range permPrerequisites {
+		if mask&perm != 0 && mask&prerequisite != prerequisite {
+			mask &^= perm
+		}
+	}
+	return mask
+}
+
+// Names of the permissions as used in configuration files
+var permNames = map[string]uint{
+	"ManageBooks":         PermManageBooks,
+	"QueryTotalStock":     PermQueryTotalStock,
+	"ChangeTotalStock":    PermChangeTotalStock,
+	"QueryUsers":          PermQueryUsers,
+	"ManageUsers":         PermManageUsers,
+	"GrantPermissions":    PermGrantPermissions,
+	"LoanBooks":           PermLoanBooks,
+	"QueryAvailableStock": PermQueryAvailableStock,
+	"QueryReservations":   PermQueryReservations,
+}
+
+// ParsePermission returns the permission with the given name, e.g. "ManageBooks"
+func ParsePermission(name string) (uint, error) {
+	if perm, ok := permNames[name]; ok {
+		return perm, nil
+	}
+	return 0, fmt.Errorf("unknown permission %q", name)
+}
@@ -0,0 +1,159 @@
+package library_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// User service answering with the given statuses in turn, the last one repeats
+func newUserServer(t *testing.T, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		w.WriteHeader(status)
+		w.Write([]byte(`{"user_id": "42", "permissios": "65"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &calls
+}
+
+func newTestClient(server *httptest.Server, opts ...library.UserClientOption) *library.UserServiceClient {
+	opts = append([]library.UserClientOption{library.WithUserRetries(2, time.Millisecond, time.Millisecond)}, opts...)
+	return library.NewUserServiceClient(strings.TrimPrefix(server.URL, "http://"), opts...)
+}
+
+func TestUserServiceClient_Authenticate(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		statuses  []int
+		want      uint
+		wantErr   error
+		wantCalls int32
+	}{
+		{"granted", []int{http.StatusOK}, 65, nil, 1},
+		{"rejected", []int{http.StatusUnauthorized}, 0, oops.ErrInvalidToken, 1},
+		{"unknown token", []int{http.StatusNotFound}, 0, oops.ErrInvalidToken, 1},
+		{"failing service", []int{http.StatusBadGateway}, 0, oops.ErrUserServiceUnavailable, 3},
+		{"recovered service", []int{http.StatusServiceUnavailable, http.StatusOK}, 65, nil, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, calls := newUserServer(t, tt.statuses...)
+
+			principal, err := newTestClient(server).Authenticate(ctx, "token")
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("want error %v, got %v", tt.wantErr, err)
+			}
+			if err == nil && (principal.Permissions != tt.want || principal.UserID != "42") {
+				t.Errorf("want permissions %d of user 42, got %+v", tt.want, principal)
+			}
+			if calls.Load() != tt.wantCalls {
+				t.Errorf("want %d calls, got %d", tt.wantCalls, calls.Load())
+			}
+		})
+	}
+
+	t.Run("unreachable", func(t *testing.T) {
+		server := httptest.NewServer(http.NotFoundHandler())
+		server.Close()
+
+		if _, err := newTestClient(server).Authenticate(ctx, "token"); !errors.Is(err, oops.ErrUserServiceUnavailable) {
+			t.Errorf("want %v, got %v", oops.ErrUserServiceUnavailable, err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		defer server.Close()
+		defer close(release)
+
+		client := newTestClient(server, library.WithUserTimeout(10*time.Millisecond), library.WithUserRetries(0, 0, 0))
+		if _, err := client.Authenticate(ctx, "token"); !errors.Is(err, oops.ErrUserServiceUnavailable) {
+			t.Errorf("want %v, got %v", oops.ErrUserServiceUnavailable, err)
+		}
+	})
+
+	t.Run("circuit breaker", func(t *testing.T) {
+		clock := &fixedClock{now: time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)}
+		server, calls := newUserServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+		client := newTestClient(server,
+			library.WithUserRetries(0, 0, 0),
+			library.WithUserBreaker(2, time.Minute, clock))
+
+		for i := 0; i < 2; i++ {
+			client.Authenticate(ctx, "token")
+		}
+
+		// Open circuit fails without calling the service
+		if _, err := client.Authenticate(ctx, "token"); !errors.Is(err, oops.ErrUserServiceUnavailable) {
+			t.Errorf("want %v, got %v", oops.ErrUserServiceUnavailable, err)
+		}
+		if calls.Load() != 2 {
+			t.Errorf("want 2 calls, got %d", calls.Load())
+		}
+
+		// After the cooldown a probe closes the circuit
+		clock.now = clock.now.Add(time.Minute)
+		if _, err := client.Authenticate(ctx, "token"); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if _, err := client.Authenticate(ctx, "token"); err != nil {
+			t.Errorf("unexpected error %v", err)
+		}
+		if calls.Load() != 4 {
+			t.Errorf("want 4 calls, got %d", calls.Load())
+		}
+	})
+}
+
+// The request ID travels to the user service
+func TestUserServiceClient_requestID(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-Request-ID")
+		w.Write([]byte(`{"user_id": "42", "permissios": "1"}`))
+	}))
+	t.Cleanup(server.Close)
+
+	ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "req-1")
+	if _, err := newTestClient(server).Authenticate(ctx, "token"); err != nil {
+		t.Fatal(err)
+	}
+	if got != "req-1" {
+		t.Errorf("want request ID req-1, got %q", got)
+	}
+}
+
+func TestUserServiceClient_Ping(t *testing.T) {
+	server, _ := newUserServer(t, http.StatusNotFound, http.StatusBadGateway)
+	client := newTestClient(server)
+
+	// Any answer but a server error means the service is up
+	if err := client.Ping(context.Background()); err != nil {
+		t.Errorf("want reachable service, got %v", err)
+	}
+	if err := client.Ping(context.Background()); !errors.Is(err, oops.ErrUserServiceUnavailable) {
+		t.Errorf("want unavailable service, got %v", err)
+	}
+	server.Close()
+	if err := client.Ping(context.Background()); !errors.Is(err, oops.ErrUserServiceUnavailable) {
+		t.Errorf("want unreachable service, got %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package library
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+// Defaults of the permission cache
+const (
+	DefaultCacheTTL         = 30 * time.Second
+	DefaultCacheNegativeTTL = 5 * time.Second
+	DefaultCacheSize        = 1024
+)
+
+// CacheStats are counters describing the cache efficiency
+type CacheStats struct {
+	Hits         uint64 `json:"hits"`
+	NegativeHits uint64 `json:"negative_hits"`
+	Misses       uint64 `json:"misses"`
+	Coalesced    uint64 `json:"coalesced"`
+	Evictions    uint64 `json:"evictions"`
+	Size         int    `json:"size"`
+}
+
+// Tokens are kept hashed, so a memory dump doesn't leak them
+type tokenKey [sha256.Size]byte
+
+type cacheEntry struct {
+	key tokenKey
+	// Kept without its token, which the caller holds anyway
+	principal Principal
+	// Set for tokens the user service rejected
+	err     error
+	expires time.Time
+}
+
+// CachedUserService remembers principals returned by another UserService.
+// Entries expire after a TTL and the least recently used ones are evicted
+// once the cache is full. Rejected tokens are remembered for a shorter time,
+// and concurrent lookups of the same token share one upstream request.
+type CachedUserService struct {
+	next        UserService
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	clock       Clock
+
+	mu      sync.Mutex
+	entries map[tokenKey]*list.Element
+	lru     *list.List
+	// Bumped by invalidations, lookups started before one don't store their result
+	epoch uint64
+
+	group singleflight.Group
+
+	hits, negativeHits, misses, coalesced, evictions atomic.Uint64
+}
+
+// CacheOption configures a CachedUserService
+type CacheOption func(*CachedUserService)
+
+// WithCacheTTL sets how long resolved principals are kept
+func WithCacheTTL(ttl time.Duration) CacheOption {
+	return func(c *CachedUserService) { c.ttl = ttl }
+}
+
+// WithCacheNegativeTTL sets how long rejected tokens are kept, zero disables negative caching
+func WithCacheNegativeTTL(ttl time.Duration) CacheOption {
+	return func(c *CachedUserService) { c.negativeTTL = ttl }
+}
+
+// WithCacheSize sets the maximal number of remembered tokens
+func WithCacheSize(size int) CacheOption {
+	return func(c *CachedUserService) { c.size = size }
+}
+
+// WithCacheClock sets the clock entries expire by
+func WithCacheClock(clock Clock) CacheOption {
+	return func(c *CachedUserService) { c.clock = clock }
+}
+
+func NewCachedUserService(next UserService, opts ...CacheOption) *CachedUserService {
+	c := &CachedUserService{
+		next:        next,
+		ttl:         DefaultCacheTTL,
+		negativeTTL: DefaultCacheNegativeTTL,
+		size:        DefaultCacheSize,
+		clock:       SystemClock,
+		entries:     make(map[tokenKey]*list.Element),
+		lru:         list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.size <= 0 {
+		c.size = DefaultCacheSize
+	}
+	return c
+}
+
+// Resolve the token, from the cache when possible
+func (c *CachedUserService) Authenticate(ctx context.Context, token string) (*Principal, error) {
+	key := tokenKey(sha256.Sum256([]byte(token)))
+
+	if entry, ok := c.get(key); ok {
+		if entry.err != nil {
+			c.negativeHits.Add(1)
+		} else {
+			c.hits.Add(1)
+		}
+		return entry.result(token)
+	}
+	c.misses.Add(1)
+
+	// Callers coming after an invalidation don't join lookups started before it
+	epoch := c.currentEpoch()
+	results := c.group.DoChan(string(key[:])+strconv.FormatUint(epoch, 10), func() (any, error) {
+		// A lookup that just finished may have filled the entry
+		if entry, ok := c.get(key); ok {
+			return entry.result(token)
+		}
+
+		// The lookup is shared, so it must outlive the caller that started it
+		principal, err := c.next.Authenticate(context.WithoutCancel(ctx), token)
+		ttl, negativeTTL := c.TTL()
+		switch {
+		case err == nil:
+			cached := *principal
+			cached.Token = ""
+			c.put(cacheEntry{key: key, principal: cached, expires: c.clock.Now().Add(ttl)}, epoch)
+		case errors.Is(err, oops.ErrInvalidToken) && negativeTTL > 0:
+			c.put(cacheEntry{key: key, err: err, expires: c.clock.Now().Add(negativeTTL)}, epoch)
+		}
+		// Other errors are transient and never cached
+		return principal, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		if result.Shared {
+			c.coalesced.Add(1)
+		}
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		// Every caller gets its own copy
+		principal := *result.Val.(*Principal)
+		return &principal, nil
+	}
+}
+
+// Principal of the entry holding the token it was looked up by
+func (e cacheEntry) result(token string) (*Principal, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	principal := e.principal
+	principal.Token = token
+	return &principal, nil
+}
+
+// SetTTL changes how long resolved principals and rejected tokens are kept.
+// Remembered entries keep their expiry.
+func (c *CachedUserService) SetTTL(ttl, negativeTTL time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl, c.negativeTTL = ttl, negativeTTL
+}
+
+// TTL returns how long resolved principals and rejected tokens are kept
+func (c *CachedUserService) TTL() (ttl, negativeTTL time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.ttl, c.negativeTTL
+}
+
+// Invalidate forgets the token, e.g. after its permissions were changed or it was revoked.
+// Lookups in flight don't store their result, and later ones go to the user service again.
+func (c *CachedUserService) Invalidate(token string) {
+	key := tokenKey(sha256.Sum256([]byte(token)))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// InvalidateAll forgets every token
+func (c *CachedUserService) InvalidateAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	c.entries = make(map[tokenKey]*list.Element)
+	c.lru.Init()
+}
+
+// Stats returns the current cache counters
+func (c *CachedUserService) Stats() CacheStats {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		Coalesced:    c.coalesced.Load(),
+		Evictions:    c.evictions.Load(),
+		Size:         size,
+	}
+}
+
+func (c *CachedUserService) get(key tokenKey) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+
+	entry := elem.Value.(cacheEntry)
+	if !c.clock.Now().Before(entry.expires) {
+		c.remove(elem)
+		return cacheEntry{}, false
+	}
+
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *CachedUserService) currentEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.epoch
+}
+
+// Store the entry of a lookup started at the epoch, unless an invalidation came in between
+func (c *CachedUserService) put(entry cacheEntry, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.epoch != epoch {
+		return
+	}
+
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Must be called with the mutex held
+func (c *CachedUserService) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(cacheEntry).key)
+}
@@ -0,0 +1,197 @@
+package library_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// User service counting lookups, "bad" tokens are rejected
+type countingUserService struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (s *countingUserService) Authenticate(ctx context.Context, token string) (*library.Principal, error) {
+	s.calls.Add(1)
+	if s.release != nil {
+		<-s.release
+	}
+	if token == "bad" {
+		return nil, oops.ErrInvalidToken
+	}
+	return library.NewPrincipal("42", token, library.PermManageBooks), nil
+}
+
+func TestCachedUserService(t *testing.T) {
+	ctx := context.Background()
+	clock := &fixedClock{now: time.Date(2024, time.November, 20, 12, 0, 0, 0, time.UTC)}
+
+	t.Run("TTL", func(t *testing.T) {
+		upstream := &countingUserService{}
+		cache := library.NewCachedUserService(upstream, library.WithCacheTTL(time.Minute), library.WithCacheClock(clock))
+
+		for i := 0; i < 3; i++ {
+			if principal, err := cache.Authenticate(ctx, "token"); err != nil || principal.Permissions != library.PermManageBooks {
+				t.Fatalf("unexpected result %+v, %v", principal, err)
+			}
+		}
+		if calls := upstream.calls.Load(); calls != 1 {
+			t.Errorf("want 1 upstream call, got %d", calls)
+		}
+
+		clock.now = clock.now.Add(time.Minute)
+		cache.Authenticate(ctx, "token")
+		if calls := upstream.calls.Load(); calls != 2 {
+			t.Errorf("want a new upstream call after expiry, got %d calls", calls)
+		}
+
+		cache.Invalidate("token")
+		cache.Authenticate(ctx, "token")
+		if calls := upstream.calls.Load(); calls != 3 {
+			t.Errorf("want a new upstream call after invalidation, got %d calls", calls)
+		}
+
+		stats := cache.Stats()
+		if stats.Hits != 2 || stats.Misses != 3 || stats.Size != 1 {
+			t.Errorf("wrong stats %+v", stats)
+		}
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		cache := library.NewCachedUserService(&countingUserService{}, library.WithCacheClock(clock))
+
+		for i := 0; i < 2; i++ {
+			if principal, err := cache.Authenticate(ctx, "secret"); err != nil || principal.Token != "secret" {
+				t.Fatalf("want the token given back to the caller, got %+v, %v", principal, err)
+			}
+		}
+		for _, principal := range cache.CachedPrincipals() {
+			if principal.Token != "" {
+				t.Errorf("want no raw token kept in the cache, got %q", principal.Token)
+			}
+		}
+	})
+
+	t.Run("Negative", func(t *testing.T) {
+		upstream := &countingUserService{}
+		cache := library.NewCachedUserService(upstream, library.WithCacheClock(clock))
+
+		for i := 0; i < 2; i++ {
+			if _, err := cache.Authenticate(ctx, "bad"); !errors.Is(err, oops.ErrInvalidToken) {
+				t.Fatalf("want %v, got %v", oops.ErrInvalidToken, err)
+			}
+		}
+		if calls := upstream.calls.Load(); calls != 1 {
+			t.Errorf("want 1 upstream call, got %d", calls)
+		}
+		if stats := cache.Stats(); stats.NegativeHits != 1 {
+			t.Errorf("wrong stats %+v", stats)
+		}
+	})
+
+	t.Run("LRU", func(t *testing.T) {
+		upstream := &countingUserService{}
+		cache := library.NewCachedUserService(upstream, library.WithCacheSize(2), library.WithCacheClock(clock))
+
+		cache.Authenticate(ctx, "a")
+		cache.Authenticate(ctx, "b")
+		cache.Authenticate(ctx, "a")
+		cache.Authenticate(ctx, "c") // evicts "b"
+		cache.Authenticate(ctx, "a")
+		if calls := upstream.calls.Load(); calls != 3 {
+			t.Errorf("want 3 upstream calls, got %d", calls)
+		}
+		cache.Authenticate(ctx, "b")
+		if calls := upstream.calls.Load(); calls != 4 {
+			t.Errorf("want evicted token to be fetched again, got %d calls", calls)
+		}
+		if stats := cache.Stats(); stats.Evictions != 2 || stats.Size != 2 {
+			t.Errorf("wrong stats %+v", stats)
+		}
+	})
+
+	t.Run("Coalescing", func(t *testing.T) {
+		upstream := &countingUserService{release: make(chan struct{})}
+		cache := library.NewCachedUserService(upstream, library.WithCacheClock(clock))
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cache.Authenticate(ctx, "token")
+			}()
+		}
+
+		// Let every lookup reach the cache before the upstream answers
+		for cache.Stats().Misses < 5 {
+			time.Sleep(time.Millisecond)
+		}
+		close(upstream.release)
+		wg.Wait()
+
+		if calls := upstream.calls.Load(); calls != 1 {
+			t.Errorf("want 1 upstream call, got %d", calls)
+		}
+	})
+
+	t.Run("InvalidateInFlight", func(t *testing.T) {
+		upstream := &countingUserService{release: make(chan struct{})}
+		cache := library.NewCachedUserService(upstream, library.WithCacheClock(clock))
+		waitCalls := func(n int32) {
+			deadline := time.Now().Add(time.Second)
+			for upstream.calls.Load() < n {
+				if time.Now().After(deadline) {
+					t.Fatalf("want %d upstream calls, got %d", n, upstream.calls.Load())
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		var wg sync.WaitGroup
+		lookup := func() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				cache.Authenticate(ctx, "token")
+			}()
+		}
+
+		// The token is revoked while the user service still answers the lookup
+		lookup()
+		waitCalls(1)
+		cache.Invalidate("token")
+		// Lookups after the invalidation don't wait for the stale answer
+		lookup()
+		waitCalls(2)
+		close(upstream.release)
+		wg.Wait()
+
+		// Only the lookup started after the invalidation was cached
+		if _, err := cache.Authenticate(ctx, "token"); err != nil {
+			t.Fatal(err)
+		}
+		if calls := upstream.calls.Load(); calls != 2 {
+			t.Errorf("want 2 upstream calls, got %d", calls)
+		}
+
+		// Without a later lookup the stale answer leaves nothing behind
+		upstream = &countingUserService{release: make(chan struct{})}
+		cache = library.NewCachedUserService(upstream, library.WithCacheClock(clock))
+		lookup()
+		waitCalls(1)
+		cache.Invalidate("token")
+		close(upstream.release)
+		wg.Wait()
+		if size := cache.Stats().Size; size != 0 {
+			t.Errorf("want the stale principal kept out of the cache, got %d entries", size)
+		}
+	})
+}
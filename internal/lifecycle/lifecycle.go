@@ -0,0 +1,162 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A registered component, stopped in reverse order of registration
+type component struct {
+	name string
+	stop func(ctx context.Context) error
+	// Closed when the run function of a background job returns, nil for plain resources
+	done chan struct{}
+	err  error
+}
+
+// Manager runs the background jobs of the service and, on shutdown, stops every
+// component in reverse order of registration, so that nothing is closed while
+// something registered after it may still use it.
+type Manager struct {
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	components []*component
+	stopping   bool
+	stopOnce   sync.Once
+	stopErr    error
+
+	// The first job failing before shutdown
+	failed chan error
+}
+
+func New(logger *slog.Logger) *Manager {
+	return &Manager{logger: logger, failed: make(chan error, 1)}
+}
+
+// OnStop registers a resource, e.g. a store or a client, released by stop at shutdown
+func (m *Manager) OnStop(name string, stop func(ctx context.Context) error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.components = append(m.components, &component{name: name, stop: stop})
+}
+
+// Serve starts run in the background, e.g. a server. At shutdown stop has to make run return,
+// draining the work in flight first. Run failing before shutdown begins starts the shutdown.
+func (m *Manager) Serve(name string, run func() error, stop func(ctx context.Context) error) {
+	c := &component{name: name, stop: stop, done: make(chan struct{})}
+	m.mu.Lock()
+	m.components = append(m.components, c)
+	m.mu.Unlock()
+
+	go func() {
+		defer close(c.done)
+		err := run()
+		m.mu.Lock()
+		stopping := m.stopping
+		m.mu.Unlock()
+
+		if stopping {
+			if err != nil {
+				c.err = fmt.Errorf("%s: %w", name, err)
+			}
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped unexpectedly")
+		}
+		select {
+		case m.failed <- fmt.Errorf("%s: %w", name, err):
+		default:
+		}
+	}()
+}
+
+// Go starts a background job running until its context is canceled at shutdown
+func (m *Manager) Go(name string, job func(ctx context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.Serve(name,
+		func() error {
+			err := job(ctx)
+			if errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		},
+		func(context.Context) error {
+			cancel()
+			return nil
+		})
+}
+
+// Run blocks until SIGINT or SIGTERM arrives, the context is done or a background job fails,
+// then stops the service, waiting at most the timeout for it (zero waits as long as it takes).
+// It returns the failure of the job along with everything that failed to stop.
+func (m *Manager) Run(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var cause error
+	select {
+	case <-ctx.Done():
+		m.logger.Info("shutting down gracefully")
+	case cause = <-m.failed:
+		m.logger.Error("shutting down after failure", "error", cause)
+	}
+	// From now on a second signal kills the process at once
+	cancel()
+
+	return errors.Join(cause, m.Stop(timeout))
+}
+
+// Stop stops every component in reverse order of registration within the timeout.
+// Background jobs are waited for before the components registered ahead of them are stopped.
+// Only the first call stops anything, later ones return its result.
+func (m *Manager) Stop(timeout time.Duration) error {
+	m.stopOnce.Do(func() {
+		m.mu.Lock()
+		m.stopping = true
+		components := m.components
+		m.mu.Unlock()
+
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		var errs []error
+		for i := len(components) - 1; i >= 0; i-- {
+			c := components[i]
+			start := time.Now()
+			err := c.stop(ctx)
+			if err == nil && c.done != nil {
+				select {
+				case <-c.done:
+					err = c.err
+				case <-ctx.Done():
+					err = fmt.Errorf("%s: %w", c.name, ctx.Err())
+				}
+			} else if err != nil {
+				err = fmt.Errorf("%s: %w", c.name, err)
+			}
+
+			if err != nil {
+				m.logger.Error("failed to stop", "component", c.name, "error", err)
+				errs = append(errs, err)
+				continue
+			}
+			m.logger.Debug("stopped", "component", c.name, "latency", time.Since(start))
+		}
+		m.stopErr = errors.Join(errs...)
+	})
+	return m.stopErr
+}
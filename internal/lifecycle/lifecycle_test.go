@@ -0,0 +1,77 @@
+package lifecycle_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/lifecycle"
+)
+
+func TestManager(t *testing.T) {
+	m := lifecycle.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	var mu sync.Mutex
+	var stopped []string
+	record := func(name string) {
+		mu.Lock()
+		defer mu.Unlock()
+		stopped = append(stopped, name)
+	}
+
+	m.OnStop("tracing", func(context.Context) error { record("tracing"); return nil })
+	m.OnStop("database", func(context.Context) error { record("database"); return errors.New("locked") })
+	m.Go("snapshots", func(ctx context.Context) error {
+		<-ctx.Done()
+		// The job still uses the database while it finishes
+		time.Sleep(10 * time.Millisecond)
+		record("snapshots")
+		return ctx.Err()
+	})
+	release := make(chan struct{})
+	m.Serve("http", func() error { <-release; return nil }, func(context.Context) error {
+		record("http")
+		close(release)
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := m.Run(ctx, time.Second)
+
+	// Components are stopped in reverse order, each job finishing before the ones registered ahead of it
+	if got, want := strings.Join(stopped, " "), "http snapshots database tracing"; got != want {
+		t.Errorf("want stopped in order %q, got %q", want, got)
+	}
+	if err == nil || err.Error() != "database: locked" {
+		t.Errorf("want failure to stop reported, got %v", err)
+	}
+	if again := m.Stop(time.Second); again == nil || again.Error() != err.Error() {
+		t.Errorf("want stop done once, got %v", again)
+	}
+}
+
+func TestManager_failure(t *testing.T) {
+	m := lifecycle.New(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	// A job failing ends the run, a job ignoring the shutdown is given up on after the timeout
+	m.Go("stuck", func(ctx context.Context) error { select {} })
+	m.Serve("http", func() error { return errors.New("address already in use") }, func(context.Context) error { return nil })
+
+	done := make(chan error)
+	go func() { done <- m.Run(context.Background(), 20*time.Millisecond) }()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "http: address already in use") ||
+			!strings.Contains(err.Error(), "stuck: context deadline exceeded") {
+			t.Errorf("want failure and timeout reported, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("run didn't end after the failure")
+	}
+}
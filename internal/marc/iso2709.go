@@ -0,0 +1,202 @@
+package marc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ISO 2709 delimiters
+const (
+	subfieldDelimiter = 0x1F
+	fieldTerminator   = 0x1E
+	recordTerminator  = 0x1D
+)
+
+const (
+	leaderLength         = 24
+	directoryEntryLength = 12
+)
+
+// ErrMalformed is returned for records which don't follow ISO 2709
+var ErrMalformed = errors.New("malformed MARC record")
+
+// Reader decodes binary MARC 21 (ISO 2709) records from a stream
+type Reader struct {
+	r *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Read returns the next record or io.EOF at the end of the stream.
+// Malformed records are reported with ErrMalformed and skipped,
+// so reading may continue after such an error.
+func (r *Reader) Read() (*Record, error) {
+	// Skip line breaks some tools put between records
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b != '\n' && b != '\r' {
+			r.r.UnreadByte()
+			break
+		}
+	}
+
+	prefix, err := r.r.Peek(5)
+	if err != nil && len(prefix) == 0 {
+		return nil, err
+	}
+	length, ok := digits(prefix)
+	if !ok || length < leaderLength+1 {
+		// The length can't be trusted, so skip to the next record terminator
+		if _, err := r.r.ReadBytes(recordTerminator); err != nil && err != io.EOF {
+			return nil, err
+		}
+		return nil, errors.Wrapf(ErrMalformed, "invalid record length %q", prefix)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.Wrap(ErrMalformed, "truncated record")
+		}
+		return nil, err
+	}
+
+	return Parse(data)
+}
+
+// Parse decodes a single ISO 2709 record
+func Parse(data []byte) (*Record, error) {
+	if len(data) < leaderLength+1 {
+		return nil, errors.Wrap(ErrMalformed, "record is shorter than its leader")
+	}
+	if data[len(data)-1] != recordTerminator {
+		return nil, errors.Wrap(ErrMalformed, "missing record terminator")
+	}
+
+	record := &Record{Leader: string(data[:leaderLength])}
+	base, ok := digits(data[12:17])
+	if !ok || base <= leaderLength || base > len(data) {
+		return nil, errors.Wrapf(ErrMalformed, "invalid base address %q", record.Leader[12:17])
+	}
+
+	directory := data[leaderLength : base-1]
+	if data[base-1] != fieldTerminator || len(directory)%directoryEntryLength != 0 {
+		return nil, errors.Wrap(ErrMalformed, "invalid directory")
+	}
+
+	for i := 0; i < len(directory); i += directoryEntryLength {
+		entry := directory[i : i+directoryEntryLength]
+		tag := string(entry[:3])
+		length, ok1 := digits(entry[3:7])
+		start, ok2 := digits(entry[7:12])
+		if !ok1 || !ok2 || length < 1 || base+start+length > len(data) {
+			return nil, errors.Wrapf(ErrMalformed, "invalid directory entry for field %s", tag)
+		}
+
+		value := data[base+start : base+start+length]
+		if value[len(value)-1] != fieldTerminator {
+			return nil, errors.Wrapf(ErrMalformed, "field %s is not terminated", tag)
+		}
+		value = value[:len(value)-1]
+
+		field := Field{Tag: tag}
+		if field.IsControl() {
+			field.Value = string(value)
+			record.Fields = append(record.Fields, field)
+			continue
+		}
+
+		if len(value) < 2 {
+			return nil, errors.Wrapf(ErrMalformed, "field %s has no indicators", tag)
+		}
+		field.Ind1, field.Ind2 = value[0], value[1]
+		for _, sf := range bytes.Split(value[2:], []byte{subfieldDelimiter}) {
+			if len(sf) == 0 {
+				continue
+			}
+			field.Subfields = append(field.Subfields, Subfield{Code: sf[0], Value: string(sf[1:])})
+		}
+		record.Fields = append(record.Fields, field)
+	}
+
+	return record, nil
+}
+
+// Value of a number of the leader or directory. Those are plain ASCII digits, so
+// signs and spaces, which strconv accepts or which make negative offsets, are rejected.
+func digits(b []byte) (int, bool) {
+	if len(b) == 0 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int(c-'0')
+	}
+	return n, true
+}
+
+// Writer encodes records as binary MARC 21 (ISO 2709)
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteRecord encodes the record, computing its length and directory
+func (w *Writer) WriteRecord(r *Record) error {
+	var directory, body bytes.Buffer
+	for _, f := range r.Fields {
+		start := body.Len()
+		if f.IsControl() {
+			body.WriteString(f.Value)
+		} else {
+			body.WriteByte(indicatorByte(f.Ind1))
+			body.WriteByte(indicatorByte(f.Ind2))
+			for _, sf := range f.Subfields {
+				body.WriteByte(subfieldDelimiter)
+				body.WriteByte(sf.Code)
+				body.WriteString(sf.Value)
+			}
+		}
+		body.WriteByte(fieldTerminator)
+		fmt.Fprintf(&directory, "%3s%04d%05d", f.Tag, body.Len()-start, start)
+	}
+	directory.WriteByte(fieldTerminator)
+	body.WriteByte(recordTerminator)
+
+	leader := []byte(r.Leader)
+	if len(leader) != leaderLength {
+		leader = []byte(DefaultLeader)
+	}
+	base := leaderLength + directory.Len()
+	copy(leader[0:5], fmt.Sprintf("%05d", base+body.Len()))
+	copy(leader[12:17], fmt.Sprintf("%05d", base))
+
+	for _, part := range [][]byte{leader, directory.Bytes(), body.Bytes()} {
+		if _, err := w.w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indicatorByte(b byte) byte {
+	if b == 0 {
+		return ' '
+	}
+	return b
+}
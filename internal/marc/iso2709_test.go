@@ -0,0 +1,117 @@
+package marc_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/marc"
+)
+
+func TestReader(t *testing.T) {
+	first := &marc.Record{Leader: marc.DefaultLeader}
+	first.AddControlField("001", "42")
+	first.AddDataField("020", ' ', ' ', marc.Subfield{Code: 'a', Value: "9780134190440 (paperback)"})
+	first.AddDataField("245", '1', '4', marc.Subfield{Code: 'a', Value: "The Go programming language /"}, marc.Subfield{Code: 'c', Value: "Alan A. A. Donovan."})
+
+	second := &marc.Record{Leader: marc.DefaultLeader}
+	second.AddControlField("001", "43")
+	second.AddDataField("245", '0', '0', marc.Subfield{Code: 'a', Value: "Война и мир"})
+
+	var buf bytes.Buffer
+	w := marc.NewWriter(&buf)
+	if err := w.WriteRecord(first); err != nil {
+		t.Fatal(err)
+	}
+	// A record with a broken length prefix in between the good ones
+	buf.WriteString("xx123 garbage\x1d")
+	if err := w.WriteRecord(second); err != nil {
+		t.Fatal(err)
+	}
+
+	r := marc.NewReader(&buf)
+
+	got, err := r.Read()
+	if err != nil {
+		t.Fatalf("Read failed: %s", err)
+	}
+	if diff := cmp.Diff(first.Fields, got.Fields); diff != "" {
+		t.Errorf("first record mismatch: (-want +got)\n%s", diff)
+	}
+
+	if _, err := r.Read(); !errors.Is(err, marc.ErrMalformed) {
+		t.Errorf("expected malformed record error, got %v", err)
+	}
+
+	got, err = r.Read()
+	if err != nil {
+		t.Fatalf("Read failed after malformed record: %s", err)
+	}
+	if diff := cmp.Diff(second.Fields, got.Fields); diff != "" {
+		t.Errorf("second record mismatch: (-want +got)\n%s", diff)
+	}
+
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+// Numbers of the leader and the directory are plain digits, anything else is malformed
+func TestParse_malformed(t *testing.T) {
+	record := &marc.Record{Leader: marc.DefaultLeader}
+	record.AddControlField("001", "42")
+	record.AddDataField("245", '1', '4', marc.Subfield{Code: 'a', Value: "The Go programming language /"})
+	var buf bytes.Buffer
+	if err := marc.NewWriter(&buf).WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	valid := buf.Bytes()
+	if _, err := marc.Parse(valid); err != nil {
+		t.Fatalf("valid record rejected: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		offset int
+		value  string
+	}{
+		{"negative base address", 12, "-0001"},
+		{"signed base address", 12, "+0049"},
+		{"negative start", 24 + 7, "-9999"},
+		{"signed start", 24 + 7, "+0000"},
+		{"negative length", 24 + 3, "-003"},
+		{"overflowing length", 24 + 3, "9999"},
+		{"overflowing start", 24 + 7, "99999"},
+		{"non-digit length", 24 + 3, "00a3"},
+		{"space in start", 24 + 7, " 0000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := bytes.Clone(valid)
+			copy(data[tc.offset:], tc.value)
+			if _, err := marc.Parse(data); !errors.Is(err, marc.ErrMalformed) {
+				t.Errorf("want %v, got %v", marc.ErrMalformed, err)
+			}
+		})
+	}
+}
+
+// Parse must reject any input it can't decode, never panic
+func FuzzParse(f *testing.F) {
+	record := &marc.Record{Leader: marc.DefaultLeader}
+	record.AddControlField("001", "42")
+	record.AddDataField("245", '0', '0', marc.Subfield{Code: 'a', Value: "Война и мир"})
+	var buf bytes.Buffer
+	if err := marc.NewWriter(&buf).WriteRecord(record); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+	f.Add([]byte("xx123 garbage\x1d"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if _, err := marc.Parse(data); err != nil && !errors.Is(err, marc.ErrMalformed) {
+			t.Errorf("want %v for undecodable input, got %v", marc.ErrMalformed, err)
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package marc
+
+// Record is a single MARC 21 bibliographic record
+type Record struct {
+	Leader string
+	Fields []Field
+}
+
+// Field is either a control field (tags 001-009) holding a plain value,
+// or a data field with two indicators and a list of subfields
+type Field struct {
+	Tag       string
+	Value     string
+	Ind1      byte
+	Ind2      byte
+	Subfields []Subfield
+}
+
+// Subfield is a single coded value of a data field
+type Subfield struct {
+	Code  byte
+	Value string
+}
+
+// DefaultLeader is used for records built from scratch:
+// new bibliographic record for a monograph, encoded in UTF-8
+const DefaultLeader = "00000nam a2200000 u 4500"
+
+// IsControl reports whether the field is a control field
+func (f Field) IsControl() bool {
+	return len(f.Tag) == 3 && f.Tag < "010"
+}
+
+// Subfield returns the first value of the subfield with the given code
+func (f Field) Subfield(code byte) string {
+	for _, sf := range f.Subfields {
+		if sf.Code == code {
+			return sf.Value
+		}
+	}
+	return ""
+}
+
+// FieldsByTag returns all fields of the record with the given tag
+func (r *Record) FieldsByTag(tag string) []Field {
+	var fields []Field
+	for _, f := range r.Fields {
+		if f.Tag == tag {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// AddControlField appends a control field to the record
+func (r *Record) AddControlField(tag, value string) {
+	r.Fields = append(r.Fields, Field{Tag: tag, Value: value})
+}
+
+// AddDataField appends a data field to the record
+func (r *Record) AddDataField(tag string, ind1, ind2 byte, subfields ...Subfield) {
+	r.Fields = append(r.Fields, Field{Tag: tag, Ind1: ind1, Ind2: ind2, Subfields: subfields})
+}
@@ -0,0 +1,111 @@
+package marc
+
+import (
+	"encoding/xml"
+	"io"
+)
+
+// Namespace of MARC 21 XML (MARCXML) documents
+const XMLNamespace = "http://www.loc.gov/MARC21/slim"
+
+type xmlRecord struct {
+	XMLName       xml.Name          `xml:"record"`
+	Leader        string            `xml:"leader"`
+	ControlFields []xmlControlField `xml:"controlfield"`
+	DataFields    []xmlDataField    `xml:"datafield"`
+}
+
+type xmlControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type xmlDataField struct {
+	Tag       string        `xml:"tag,attr"`
+	Ind1      string        `xml:"ind1,attr"`
+	Ind2      string        `xml:"ind2,attr"`
+	Subfields []xmlSubfield `xml:"subfield"`
+}
+
+type xmlSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// XMLWriter streams records as a MARCXML collection
+type XMLWriter struct {
+	encoder *xml.Encoder
+	started bool
+}
+
+func NewXMLWriter(w io.Writer) *XMLWriter {
+	return &XMLWriter{encoder: xml.NewEncoder(w)}
+}
+
+// Write the collection start element on the first record
+func (w *XMLWriter) start() error {
+	if w.started {
+		return nil
+	}
+	w.started = true
+
+	if err := w.encoder.EncodeToken(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)}); err != nil {
+		return err
+	}
+	return w.encoder.EncodeToken(collectionStart())
+}
+
+// WriteRecord appends a record to the collection
+func (w *XMLWriter) WriteRecord(r *Record) error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	return w.encoder.Encode(toXML(r))
+}
+
+// Close finishes the collection. It does not close the underlying writer.
+func (w *XMLWriter) Close() error {
+	if err := w.start(); err != nil {
+		return err
+	}
+	if err := w.encoder.EncodeToken(collectionStart().End()); err != nil {
+		return err
+	}
+	return w.encoder.Flush()
+}
+
+func collectionStart() xml.StartElement {
+	return xml.StartElement{
+		Name: xml.Name{Local: "collection"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: XMLNamespace}},
+	}
+}
+
+func toXML(r *Record) xmlRecord {
+	rec := xmlRecord{Leader: r.Leader}
+	if rec.Leader == "" {
+		rec.Leader = DefaultLeader
+	}
+
+	for _, f := range r.Fields {
+		if f.IsControl() {
+			rec.ControlFields = append(rec.ControlFields, xmlControlField{Tag: f.Tag, Value: f.Value})
+			continue
+		}
+
+		df := xmlDataField{Tag: f.Tag, Ind1: indicator(f.Ind1), Ind2: indicator(f.Ind2)}
+		for _, sf := range f.Subfields {
+			df.Subfields = append(df.Subfields, xmlSubfield{Code: string(sf.Code), Value: sf.Value})
+		}
+		rec.DataFields = append(rec.DataFields, df)
+	}
+	return rec
+}
+
+// Unset indicators are written as blanks
+func indicator(b byte) string {
+	if b == 0 {
+		return " "
+	}
+	return string(b)
+}
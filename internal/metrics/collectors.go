@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How long counting the catalogue may hold up a scrape
+const catalogueTimeout = 5 * time.Second
+
+// How long a count of the catalogue is reused, so that frequent scrapes don't load the store
+const catalogueTTL = 15 * time.Second
+
+var (
+	booksDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "catalogue", "books"),
+		"Books in the catalogue by visibility, deleted ones excluded.", []string{"visibility"}, nil)
+	stockDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "catalogue", "stock"),
+		"Copies of all books in the catalogue.", nil, nil)
+)
+
+// Counts the catalogue in the store, at most once per catalogueTTL
+type catalogueCollector struct {
+	store library.BookCounter
+
+	mu        sync.Mutex
+	count     library.CatalogueCount
+	countedAt time.Time
+}
+
+func (c *catalogueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- booksDesc
+	ch <- stockDesc
+}
+
+func (c *catalogueCollector) Collect(ch chan<- prometheus.Metric) {
+	count, err := c.counted()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(booksDesc, err)
+		ch <- prometheus.NewInvalidMetric(stockDesc, err)
+		return
+	}
+
+	for _, visibility := range []library.Visibility{library.VisibilityPublic, library.VisibilityStaff, library.VisibilityHidden} {
+		ch <- prometheus.MustNewConstMetric(booksDesc, prometheus.GaugeValue, float64(count.Books[visibility]), string(visibility))
+	}
+	ch <- prometheus.MustNewConstMetric(stockDesc, prometheus.GaugeValue, float64(count.Stock))
+}
+
+// The last count unless it's too old. Concurrent scrapes wait for a single count.
+func (c *catalogueCollector) counted() (library.CatalogueCount, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.countedAt.IsZero() && time.Since(c.countedAt) < catalogueTTL {
+		return c.count, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), catalogueTimeout)
+	defer cancel()
+	count, err := c.store.CountBooks(ctx)
+	if err != nil {
+		return count, err
+	}
+	c.count, c.countedAt = count, time.Now()
+	return count, nil
+}
+
+var (
+	cacheLookupsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "user_cache", "lookups_total"),
+		"Token lookups in the permission cache by result.", []string{"result"}, nil)
+	cacheEvictionsDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "user_cache", "evictions_total"),
+		"Tokens evicted from the permission cache to make room.", nil, nil)
+	cacheSizeDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "user_cache", "size"),
+		"Tokens held in the permission cache.", nil, nil)
+)
+
+// Exposes the statistics the permission cache keeps anyway
+type userCacheCollector struct {
+	cache *library.CachedUserService
+}
+
+func (c *userCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheLookupsDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheSizeDesc
+}
+
+func (c *userCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.cache.Stats()
+	for result, n := range map[string]uint64{
+		"hit":          stats.Hits,
+		"negative_hit": stats.NegativeHits,
+		"miss":         stats.Misses,
+		"coalesced":    stats.Coalesced,
+	} {
+		ch <- prometheus.MustNewConstMetric(cacheLookupsDesc, prometheus.CounterValue, float64(n), result)
+	}
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(stats.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheSizeDesc, prometheus.GaugeValue, float64(stats.Size))
+}
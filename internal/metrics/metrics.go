@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prefix of every metric of the service
+const namespace = "book_service"
+
+// Route label of requests no route matched, so that scanners can't blow up the label set
+const unmatchedRoute = "unmatched"
+
+// Method label of requests with a nonstandard method, for the same reason
+const otherMethod = "OTHER"
+
+// Status label of responses the handler cut off, whatever status they started with
+const abortedStatus = "aborted"
+
+// Methods labelled as they are
+var standardMethods = map[string]bool{
+	http.MethodGet: true, http.MethodHead: true, http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodDelete: true, http.MethodConnect: true, http.MethodOptions: true, http.MethodTrace: true,
+}
+
+// Metrics collects measurements of the service and exposes them to Prometheus
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+
+	storeDuration *prometheus.HistogramVec
+	userDuration  *prometheus.HistogramVec
+}
+
+// New creates metrics registered in their own registry along with Go runtime and process metrics
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests by method, route pattern and status code, aborted for responses cut off halfway.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Latency of HTTP requests by method and route pattern.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "http_requests_in_flight",
+			Help:      "HTTP requests being served.",
+		}),
+		storeDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "store_operation_duration_seconds",
+			Help:      "Latency of book store operations by method and outcome.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"operation", "outcome"}),
+		userDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "user_service_request_duration_seconds",
+			Help:      "Latency of token lookups in the user service by outcome.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"outcome"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.duration, m.inFlight, m.storeDuration, m.userDuration,
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Middleware measures requests by the chi route pattern they matched.
+// It must be used on the root router, which knows the whole pattern once the request is served.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		observe := func(aborted bool) {
+			route := unmatchedRoute
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			status := strconv.Itoa(ww.Status())
+			switch {
+			case aborted:
+				status = abortedStatus
+			case ww.Status() == 0:
+				// Nothing was written, net/http answers 200
+				status = strconv.Itoa(http.StatusOK)
+			}
+
+			method := r.Method
+			if !standardMethods[method] {
+				method = otherMethod
+			}
+			m.requests.WithLabelValues(method, route, status).Inc()
+			m.duration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		}
+		// Handlers cut responses that fail halfway with a panic, which must not skip the measurement
+		defer func() {
+			if p := recover(); p != nil {
+				observe(true)
+				panic(p)
+			}
+		}()
+
+		next.ServeHTTP(ww, r)
+		observe(false)
+	})
+}
+
+// RegisterDB exposes connection pool statistics of the database
+func (m *Metrics) RegisterDB(name string, db *sql.DB) {
+	m.registry.MustRegister(collectors.NewDBStatsCollector(db, name))
+}
+
+// RegisterCatalogue exposes the number of books and copies in the store, counted by the store itself
+func (m *Metrics) RegisterCatalogue(store library.BookCounter) {
+	m.registry.MustRegister(&catalogueCollector{store: store})
+}
+
+// RegisterUserCache exposes the counters of the permission cache
+func (m *Metrics) RegisterUserCache(cache *library.CachedUserService) {
+	m.registry.MustRegister(&userCacheCollector{cache: cache})
+}
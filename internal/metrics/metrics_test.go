@@ -0,0 +1,104 @@
+package metrics_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/mock"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/metrics"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+)
+
+func TestMetrics(t *testing.T) {
+	ctx := context.Background()
+	m := metrics.New()
+
+	router := chi.NewRouter()
+	router.Use(m.Middleware)
+	router.Get("/books/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "id") == "0" {
+			http.NotFound(w, r)
+		}
+	})
+	router.Get("/export", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first book\n"))
+		panic(http.ErrAbortHandler)
+	})
+	router.Method(http.MethodGet, "/metrics", m.Handler())
+	for _, path := range []string{"/books/1", "/books/2", "/books/0", "/nowhere"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	for _, method := range []string{"BREW", "WHEN"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/books/1", nil))
+	}
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Errorf("want the panic passed on, got %v", p)
+			}
+		}()
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/export", nil))
+	}()
+
+	raw := memory.NewMemoryBookStore()
+	store := m.Store(raw)
+	m.RegisterCatalogue(raw)
+	for _, book := range []library.Book{
+		{ID: "1", Title: "Go Programming", Stock: "3"},
+		{ID: "2", Title: "Go Roadmap", Stock: "2", Visibility: library.VisibilityHidden},
+		{ID: "3", Title: "Go Basics"},
+	} {
+		if _, err := store.SaveBook(ctx, book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.LoadBookByID(ctx, "4"); err == nil {
+		t.Fatal("want missing book")
+	}
+
+	users := m.Users(&mock.MockUserServiceClient{Err: oops.ErrUserServiceUnavailable})
+	if _, err := users.Authenticate(ctx, "token"); err == nil {
+		t.Fatal("want unavailable user service")
+	}
+	cache := library.NewCachedUserService(&mock.MockUserServiceClient{UserID: "1"})
+	m.RegisterUserCache(cache)
+	for range 2 {
+		if _, err := cache.Authenticate(ctx, "token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rr.Body)
+	exposition := string(body)
+
+	for _, want := range []string{
+		`book_service_http_requests_total{method="GET",route="/books/{id}",status="200"} 2`,
+		`book_service_http_requests_total{method="GET",route="/books/{id}",status="404"} 1`,
+		`book_service_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`book_service_http_requests_total{method="OTHER",route="unmatched",status="405"} 2`,
+		`book_service_http_requests_total{method="GET",route="/export",status="aborted"} 1`,
+		`book_service_http_request_duration_seconds_count{method="GET",route="/books/{id}"} 3`,
+		`book_service_store_operation_duration_seconds_count{operation="SaveBook",outcome="ok"} 3`,
+		`book_service_store_operation_duration_seconds_count{operation="LoadBookByID",outcome="not_found"} 1`,
+		`book_service_user_service_request_duration_seconds_count{outcome="unavailable"} 1`,
+		`book_service_catalogue_books{visibility="public"} 2`,
+		`book_service_catalogue_books{visibility="hidden"} 1`,
+		`book_service_catalogue_stock 5`,
+		`book_service_user_cache_lookups_total{result="hit"} 1`,
+		`book_service_user_cache_lookups_total{result="miss"} 1`,
+		`book_service_user_cache_size 1`,
+	} {
+		if !strings.Contains(exposition, want+"\n") {
+			t.Errorf("missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Store measures every operation of the given store
+func (m *Metrics) Store(next library.BookStore) library.BookStore {
+	return &bookStore{next: next, metrics: m}
+}
+
+type bookStore struct {
+	next    library.BookStore
+	metrics *Metrics
+}
+
+func (s *bookStore) observe(operation string, start time.Time, err error) {
+	s.metrics.observeStore(operation, start, err)
+}
+
+func (m *Metrics) observeStore(operation string, start time.Time, err error) {
+	m.storeDuration.WithLabelValues(operation, storeOutcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// Outcome label of a store operation
+func storeOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, oops.ErrUnexistedBook):
+		return "not_found"
+	case errors.Is(err, oops.ErrDuplicateID):
+		return "conflict"
+	default:
+		return "error"
+	}
+}
+
+func (s *bookStore) LoadBooks(ctx context.Context, filter library.BookFilter) (_ []library.Book, err error) {
+	start := time.Now()
+	defer func() { s.observe("LoadBooks", start, err) }()
+	return s.next.LoadBooks(ctx, filter)
+}
+
+// The time spent in fn is measured too, as rows are read while the caller consumes them
+func (s *bookStore) IterateBooks(ctx context.Context, filter library.BookFilter, fn func(library.Book) error) (err error) {
+	start := time.Now()
+	defer func() { s.observe("IterateBooks", start, err) }()
+	return s.next.IterateBooks(ctx, filter, fn)
+}
+
+func (s *bookStore) LoadBookByID(ctx context.Context, id string, visibility ...library.Visibility) (_ *library.Book, err error) {
+	start := time.Now()
+	defer func() { s.observe("LoadBookByID", start, err) }()
+	return s.next.LoadBookByID(ctx, id, visibility...)
+}
+
+func (s *bookStore) LoadBookByISBN(ctx context.Context, isbn string, visibility ...library.Visibility) (_ *library.Book, err error) {
+	start := time.Now()
+	defer func() { s.observe("LoadBookByISBN", start, err) }()
+	return s.next.LoadBookByISBN(ctx, isbn, visibility...)
+}
+
+func (s *bookStore) SaveBook(ctx context.Context, book library.Book) (_ string, err error) {
+	start := time.Now()
+	defer func() { s.observe("SaveBook", start, err) }()
+	return s.next.SaveBook(ctx, book)
+}
+
+func (s *bookStore) UpdateBook(ctx context.Context, id string, book library.Book) (err error) {
+	start := time.Now()
+	defer func() { s.observe("UpdateBook", start, err) }()
+	return s.next.UpdateBook(ctx, id, book)
+}
+
+func (s *bookStore) DeleteBook(ctx context.Context, id string) (err error) {
+	start := time.Now()
+	defer func() { s.observe("DeleteBook", start, err) }()
+	return s.next.DeleteBook(ctx, id)
+}
+
+// Audit measures every operation of the given audit log, including the calls
+// a change makes to the books within its transaction
+func (m *Metrics) Audit(next library.AuditStore) library.AuditStore {
+	return &auditStore{next: next, metrics: m}
+}
+
+type auditStore struct {
+	next    library.AuditStore
+	metrics *Metrics
+}
+
+func (s *auditStore) AuditChange(ctx context.Context, change library.BookChange) (_ library.AuditEntry, err error) {
+	start := time.Now()
+	defer func() { s.metrics.observeStore("AuditChange", start, err) }()
+	return s.next.AuditChange(ctx, func(ctx context.Context, books library.BookStore) (library.AuditEntry, error) {
+		return change(ctx, s.metrics.Store(books))
+	})
+}
+
+func (s *auditStore) LoadAudit(ctx context.Context, filter library.AuditFilter) (_ []library.AuditEntry, err error) {
+	start := time.Now()
+	defer func() { s.metrics.observeStore("LoadAudit", start, err) }()
+	return s.next.LoadAudit(ctx, filter)
+}
+
+func (s *auditStore) IterateAudit(ctx context.Context, fn func(library.AuditEntry) error) (err error) {
+	start := time.Now()
+	defer func() { s.metrics.observeStore("IterateAudit", start, err) }()
+	return s.next.IterateAudit(ctx, fn)
+}
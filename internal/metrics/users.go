@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Users measures token lookups of the given user service. It should wrap the client
+// itself rather than the cache, so that only real calls are counted.
+func (m *Metrics) Users(next library.UserService) library.UserService {
+	return &userService{next: next, metrics: m}
+}
+
+type userService struct {
+	next    library.UserService
+	metrics *Metrics
+}
+
+func (u *userService) Authenticate(ctx context.Context, token string) (*library.Principal, error) {
+	start := time.Now()
+	principal, err := u.next.Authenticate(ctx, token)
+	u.metrics.userDuration.WithLabelValues(userOutcome(err)).Observe(time.Since(start).Seconds())
+	return principal, err
+}
+
+// Outcome label of a token lookup
+func userOutcome(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, oops.ErrInvalidToken):
+		return "invalid_token"
+	case errors.Is(err, oops.ErrUserServiceUnavailable):
+		return "unavailable"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "error"
+	}
+}
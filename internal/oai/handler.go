@@ -0,0 +1,470 @@
+package oai
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Number of records in a single list response, unless configured
+const defaultPageSize = 100
+
+// Repository describes the catalogue to harvesters
+type Repository struct {
+	Name string
+	// BaseURL of the provider, derived from the request when empty
+	BaseURL    string
+	AdminEmail string
+	// Identifier is the namespace of item identifiers: oai:<Identifier>:<book id>
+	Identifier string
+	PageSize   int
+}
+
+// Handler is an OAI-PMH 2.0 data provider exposing books as oai_dc records
+type Handler struct {
+	router  *chi.Mux
+	service library.BookService
+	repo    Repository
+	limit   *library.RateLimiter
+}
+
+// HandlerOption configures Handler
+type HandlerOption func(*Handler)
+
+// WithRateLimit throttles harvesters, nil disables the limit
+func WithRateLimit(limit *library.RateLimiter) HandlerOption {
+	return func(h *Handler) { h.limit = limit }
+}
+
+func NewHandler(router *chi.Mux, service library.BookService, repo Repository, opts ...HandlerOption) *Handler {
+	if repo.PageSize <= 0 {
+		repo.PageSize = defaultPageSize
+	}
+	h := &Handler{
+		router:  router,
+		service: service,
+		repo:    repo,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Register routes for the Handler
+func (h *Handler) Register() {
+	h.router.Group(func(r chi.Router) {
+		if h.limit != nil {
+			r.Use(h.limit.Middleware)
+		}
+		r.Get("/oai", h.serve)
+		r.Post("/oai", h.serve)
+	})
+}
+
+// Arguments allowed for each verb
+var verbArguments = map[string][]string{
+	"Identify":            {},
+	"ListMetadataFormats": {"identifier"},
+	"ListSets":            {"resumptionToken"},
+	"GetRecord":           {"identifier", "metadataPrefix"},
+	"ListIdentifiers":     {"metadataPrefix", "from", "until", "set", "resumptionToken"},
+	"ListRecords":         {"metadataPrefix", "from", "until", "set", "resumptionToken"},
+}
+
+// Handles GET and POST requests carrying an OAI-PMH verb
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	resp := &response{
+		Xmlns:          pmhNamespace,
+		XmlnsXsi:       xsiNamespace,
+		SchemaLocation: pmhSchema,
+		ResponseDate:   formatDatestamp(time.Now()),
+		Request:        request{BaseURL: h.baseURL(r)},
+	}
+
+	if args, ok := h.parseArguments(resp, r); ok {
+		// Arguments are echoed only for requests without badVerb and badArgument errors
+		resp.Request.Verb = args.Get("verb")
+		resp.Request.Identifier = args.Get("identifier")
+		resp.Request.MetadataPrefix = args.Get("metadataPrefix")
+		resp.Request.From = args.Get("from")
+		resp.Request.Until = args.Get("until")
+		resp.Request.Set = args.Get("set")
+		resp.Request.ResumptionToken = args.Get("resumptionToken")
+
+		var err error
+		switch args.Get("verb") {
+		case "Identify":
+			h.identify(resp)
+		case "ListMetadataFormats":
+			err = h.listMetadataFormats(resp, r, args)
+		case "ListSets":
+			resp.addError(errNoSetHierarchy, "This repository does not support sets")
+		case "GetRecord":
+			err = h.getRecord(resp, r, args)
+		case "ListIdentifiers", "ListRecords":
+			err = h.list(resp, r, args)
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to load books: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Responses are a page at most, encoding them up front leaves a failure its status
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(resp); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		library.LoggerFromContext(r.Context()).Warn("failed to write OAI-PMH response", "error", err)
+	}
+}
+
+// Check the verb and its arguments, reporting protocol errors in the response
+func (h *Handler) parseArguments(resp *response, r *http.Request) (arguments, bool) {
+	args := arguments(r.Form)
+	verb := args.Get("verb")
+	allowed, ok := verbArguments[verb]
+	if !ok || len(args["verb"]) != 1 {
+		resp.addError(errBadVerb, fmt.Sprintf("Illegal verb %q", verb))
+		return nil, false
+	}
+
+	for name, values := range args {
+		if name == "verb" {
+			continue
+		}
+		if !contains(allowed, name) {
+			resp.addError(errBadArgument, fmt.Sprintf("Illegal argument %q", name))
+		} else if len(values) != 1 {
+			resp.addError(errBadArgument, fmt.Sprintf("Repeated argument %q", name))
+		}
+	}
+
+	// The resumption token is an exclusive argument
+	if args.Has("resumptionToken") && len(args) > 2 {
+		resp.addError(errBadArgument, "resumptionToken can't be combined with other arguments")
+	}
+
+	switch verb {
+	case "GetRecord":
+		if !args.Has("identifier") || !args.Has("metadataPrefix") {
+			resp.addError(errBadArgument, "identifier and metadataPrefix are required")
+		}
+	case "ListIdentifiers", "ListRecords":
+		if !args.Has("resumptionToken") && !args.Has("metadataPrefix") {
+			resp.addError(errBadArgument, "metadataPrefix is required")
+		}
+	}
+
+	return args, len(resp.Errors) == 0
+}
+
+func (h *Handler) identify(resp *response) {
+	resp.Identify = &identify{
+		RepositoryName:    h.repo.Name,
+		BaseURL:           resp.Request.BaseURL,
+		ProtocolVersion:   "2.0",
+		AdminEmail:        []string{h.repo.AdminEmail},
+		EarliestDatestamp: formatDatestamp(time.Unix(0, 0)),
+		DeletedRecord:     "transient",
+		Granularity:       "YYYY-MM-DDThh:mm:ssZ",
+	}
+}
+
+func (h *Handler) listMetadataFormats(resp *response, r *http.Request, args arguments) error {
+	if args.Has("identifier") {
+		book, err := h.lookup(r, args.Get("identifier"))
+		if err != nil {
+			return err
+		}
+		if book == nil {
+			resp.addError(errIDDoesNotExist, "No such record")
+			return nil
+		}
+	}
+
+	resp.ListMetadataFormats = &listMetadataFormats{Formats: []metadataFormat{{
+		MetadataPrefix:    dcPrefix,
+		Schema:            dcSchema,
+		MetadataNamespace: dcNamespace,
+	}}}
+	return nil
+}
+
+func (h *Handler) getRecord(resp *response, r *http.Request, args arguments) error {
+	if args.Get("metadataPrefix") != dcPrefix {
+		resp.addError(errCannotDisseminateFormat, fmt.Sprintf("Only %s metadata is supported", dcPrefix))
+		return nil
+	}
+
+	book, err := h.lookup(r, args.Get("identifier"))
+	if err != nil {
+		return err
+	}
+	if book == nil {
+		resp.addError(errIDDoesNotExist, "No such record")
+		return nil
+	}
+
+	resp.GetRecord = &getRecord{Record: h.record(*book)}
+	return nil
+}
+
+// State of a list request, carried between pages in the resumption token
+type listState struct {
+	MetadataPrefix string    `json:"p"`
+	From           time.Time `json:"f,omitempty"`
+	Before         time.Time `json:"b,omitempty"`
+	AfterID        string    `json:"a,omitempty"`
+}
+
+// Handles both ListIdentifiers and ListRecords, which differ only in what is returned
+func (h *Handler) list(resp *response, r *http.Request, args arguments) error {
+	resumed := args.Has("resumptionToken")
+	var state listState
+	if resumed {
+		var ok bool
+		if state, ok = decodeToken(args.Get("resumptionToken")); !ok {
+			resp.addError(errBadResumptionToken, "Invalid resumption token")
+			return nil
+		}
+	} else if !h.parseListArguments(resp, args, &state) {
+		return nil
+	}
+
+	// One extra book tells whether there is another page. Books of every visibility are
+	// listed, so that harvesters learn about those withdrawn from the public catalogue.
+	books, err := h.service.GetBooks(library.WithSystemAccess(r.Context()), library.BookFilter{
+		UpdatedSince:   state.From,
+		UpdatedBefore:  state.Before,
+		IncludeDeleted: true,
+		AfterID:        state.AfterID,
+		Limit:          h.repo.PageSize + 1,
+	})
+	if err != nil {
+		return err
+	}
+	if len(books) == 0 {
+		resp.addError(errNoRecordsMatch, "No records match the request")
+		return nil
+	}
+
+	// The last page of a resumed list carries an empty token
+	var token *resumptionToken
+	if len(books) > h.repo.PageSize {
+		books = books[:h.repo.PageSize]
+		state.AfterID = books[len(books)-1].ID
+		token = &resumptionToken{Value: encodeToken(state)}
+	} else if resumed {
+		token = &resumptionToken{}
+	}
+
+	if args.Get("verb") == "ListIdentifiers" {
+		resp.ListIdentifiers = &listIdentifiers{ResumptionToken: token}
+		for _, book := range books {
+			resp.ListIdentifiers.Headers = append(resp.ListIdentifiers.Headers, h.header(book))
+		}
+		return nil
+	}
+
+	resp.ListRecords = &listRecords{ResumptionToken: token}
+	for _, book := range books {
+		resp.ListRecords.Records = append(resp.ListRecords.Records, h.record(book))
+	}
+	return nil
+}
+
+// Validate arguments of the first request of a list
+func (h *Handler) parseListArguments(resp *response, args arguments, state *listState) bool {
+	state.MetadataPrefix = args.Get("metadataPrefix")
+	if state.MetadataPrefix != dcPrefix {
+		resp.addError(errCannotDisseminateFormat, fmt.Sprintf("Only %s metadata is supported", dcPrefix))
+		return false
+	}
+	if args.Has("set") {
+		resp.addError(errNoSetHierarchy, "This repository does not support sets")
+		return false
+	}
+
+	from, fromStep, ok := parseDatestamp(args.Get("from"))
+	if !ok {
+		resp.addError(errBadArgument, "Invalid from datestamp")
+		return false
+	}
+	until, untilStep, ok := parseDatestamp(args.Get("until"))
+	if !ok {
+		resp.addError(errBadArgument, "Invalid until datestamp")
+		return false
+	}
+	if !from.IsZero() && !until.IsZero() {
+		if fromStep != untilStep {
+			resp.addError(errBadArgument, "from and until must have the same granularity")
+			return false
+		}
+		if from.After(until) {
+			resp.addError(errBadArgument, "from is later than until")
+			return false
+		}
+	}
+
+	// Until is inclusive at its granularity, the filter bound is exclusive
+	state.From = from
+	if !until.IsZero() {
+		state.Before = until.Add(untilStep)
+	}
+	return true
+}
+
+// Find the book by OAI identifier, nil if there is none
+func (h *Handler) lookup(r *http.Request, identifier string) (*library.Book, error) {
+	prefix := "oai:" + h.repo.Identifier + ":"
+	id, ok := strings.CutPrefix(identifier, prefix)
+	if !ok || id == "" {
+		return nil, nil
+	}
+
+	book, err := h.service.GetBookByID(library.WithSystemAccess(r.Context()), id)
+	if errors.Is(err, oops.ErrUnexistedBook) {
+		return nil, nil
+	}
+	return book, err
+}
+
+func (h *Handler) header(book library.Book) header {
+	hdr := header{
+		Identifier: "oai:" + h.repo.Identifier + ":" + book.ID,
+		Datestamp:  formatDatestamp(book.UpdatedAt),
+	}
+	if withdrawn(book) {
+		hdr.Status = "deleted"
+	}
+	return hdr
+}
+
+// Deleted books and those no longer public are deleted records to harvesters,
+// which would otherwise keep serving them
+func withdrawn(book library.Book) bool {
+	return book.DeletedAt != nil || book.Visibility != library.VisibilityPublic
+}
+
+func (h *Handler) record(book library.Book) record {
+	// Deleted records carry only the header
+	if withdrawn(book) {
+		return record{Header: h.header(book)}
+	}
+
+	dc := dublinCore{
+		XmlnsOAIDC:     dcNamespace,
+		XmlnsDC:        dcElements,
+		XmlnsXsi:       xsiNamespace,
+		SchemaLocation: dcNamespace + " " + dcSchema,
+		Title:          []string{book.Title},
+		Creator:        book.Authors(),
+		Type:           []string{"Text"},
+	}
+	if book.Description != "" {
+		dc.Description = []string{book.Description}
+	}
+	if book.Publisher != "" {
+		dc.Publisher = []string{book.Publisher}
+	}
+	if book.Year != "" {
+		dc.Date = []string{book.Year}
+	}
+	if book.ISBN != "" {
+		dc.Identifier = []string{"urn:isbn:" + book.ISBN}
+	}
+
+	return record{Header: h.header(book), Metadata: &metadata{DC: dc}}
+}
+
+func (h *Handler) baseURL(r *http.Request) string {
+	if h.repo.BaseURL != "" {
+		return h.repo.BaseURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+func (resp *response) addError(code, message string) {
+	resp.Errors = append(resp.Errors, pmhError{Code: code, Message: message})
+}
+
+// Request arguments, from either the query or a form body
+type arguments map[string][]string
+
+func (a arguments) Get(name string) string {
+	if values := a[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (a arguments) Has(name string) bool {
+	_, ok := a[name]
+	return ok
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a datestamp of either day or seconds granularity,
+// returning the granularity step as well. Empty values are allowed.
+func parseDatestamp(value string) (time.Time, time.Duration, bool) {
+	if value == "" {
+		return time.Time{}, 0, true
+	}
+	if t, err := time.Parse(secondLayout, value); err == nil {
+		return t, time.Second, true
+	}
+	if t, err := time.Parse(dayLayout, value); err == nil {
+		return t, 24 * time.Hour, true
+	}
+	return time.Time{}, 0, false
+}
+
+func encodeToken(state listState) string {
+	data, _ := json.Marshal(state)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeToken(token string) (listState, bool) {
+	var state listState
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return state, false
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, false
+	}
+	return state, state.MetadataPrefix == dcPrefix && state.AfterID != ""
+}
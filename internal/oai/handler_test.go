@@ -0,0 +1,190 @@
+package oai_test
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oai"
+)
+
+// Subset of the response the tests look at
+type response struct {
+	Errors []struct {
+		Code string `xml:"code,attr"`
+	} `xml:"error"`
+	Identify struct {
+		RepositoryName string `xml:"repositoryName"`
+	} `xml:"Identify"`
+	GetRecord struct {
+		Title string `xml:"record>metadata>dc>title"`
+	} `xml:"GetRecord"`
+	ListIdentifiers struct {
+		Identifiers     []string `xml:"header>identifier"`
+		ResumptionToken *string  `xml:"resumptionToken"`
+	} `xml:"ListIdentifiers"`
+	ListRecords struct {
+		Records []record `xml:"record"`
+	} `xml:"ListRecords"`
+}
+
+type record struct {
+	Header struct {
+		Identifier string `xml:"identifier"`
+		Status     string `xml:"status,attr"`
+	} `xml:"header"`
+	Title string `xml:"metadata>dc>title"`
+}
+
+func TestHandler(t *testing.T) {
+	bookService := library.NewBookService(memory.NewMemoryBookStore())
+	for i := 1; i <= 3; i++ {
+		book := library.Book{ID: fmt.Sprint(i), Title: fmt.Sprintf("Book %d", i), Author: "Author"}
+		if _, err := bookService.CreateBook(context.Background(), book); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := chi.NewRouter()
+	h := oai.NewHandler(router, bookService, oai.Repository{
+		Name:       "Test library",
+		Identifier: "test",
+		PageSize:   2,
+	})
+	h.Register()
+
+	get := func(t *testing.T, args url.Values) response {
+		req, err := http.NewRequest(http.MethodGet, "/oai?"+args.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: want %d, got %d", http.StatusOK, rr.Code)
+		}
+		if ct := rr.Header().Get("Content-Type"); ct != "text/xml; charset=utf-8" || !strings.HasPrefix(rr.Body.String(), xml.Header) {
+			t.Fatalf("want an XML document, got %q: %s", ct, rr.Body)
+		}
+		var resp response
+		if err := xml.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	t.Run("Identify", func(t *testing.T) {
+		resp := get(t, url.Values{"verb": {"Identify"}})
+		if resp.Identify.RepositoryName != "Test library" {
+			t.Errorf("wrong repository name %q", resp.Identify.RepositoryName)
+		}
+	})
+
+	t.Run("BadVerb", func(t *testing.T) {
+		resp := get(t, url.Values{"verb": {"Harvest"}})
+		if len(resp.Errors) != 1 || resp.Errors[0].Code != "badVerb" {
+			t.Errorf("expected badVerb error, got %+v", resp.Errors)
+		}
+	})
+
+	t.Run("GetRecord", func(t *testing.T) {
+		resp := get(t, url.Values{"verb": {"GetRecord"}, "identifier": {"oai:test:2"}, "metadataPrefix": {"oai_dc"}})
+		if resp.GetRecord.Title != "Book 2" {
+			t.Errorf("wrong title %q", resp.GetRecord.Title)
+		}
+
+		resp = get(t, url.Values{"verb": {"GetRecord"}, "identifier": {"oai:test:42"}, "metadataPrefix": {"oai_dc"}})
+		if len(resp.Errors) != 1 || resp.Errors[0].Code != "idDoesNotExist" {
+			t.Errorf("expected idDoesNotExist error, got %+v", resp.Errors)
+		}
+	})
+
+	t.Run("ListIdentifiers", func(t *testing.T) {
+		resp := get(t, url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"oai_dc"}})
+		if len(resp.ListIdentifiers.Identifiers) != 2 || resp.ListIdentifiers.ResumptionToken == nil {
+			t.Fatalf("expected first page with a resumption token, got %+v", resp.ListIdentifiers)
+		}
+
+		token := *resp.ListIdentifiers.ResumptionToken
+		resp = get(t, url.Values{"verb": {"ListIdentifiers"}, "resumptionToken": {token}})
+		if len(resp.ListIdentifiers.Identifiers) != 1 || resp.ListIdentifiers.Identifiers[0] != "oai:test:3" {
+			t.Errorf("wrong second page %+v", resp.ListIdentifiers.Identifiers)
+		}
+		if resp.ListIdentifiers.ResumptionToken == nil || *resp.ListIdentifiers.ResumptionToken != "" {
+			t.Errorf("expected empty resumption token on the last page")
+		}
+	})
+
+	t.Run("ListIdentifiersFrom", func(t *testing.T) {
+		resp := get(t, url.Values{"verb": {"ListIdentifiers"}, "metadataPrefix": {"oai_dc"}, "from": {"2999-01-01"}})
+		if len(resp.Errors) != 1 || resp.Errors[0].Code != "noRecordsMatch" {
+			t.Errorf("expected noRecordsMatch error, got %+v", resp.Errors)
+		}
+	})
+}
+
+func TestHandler_rateLimit(t *testing.T) {
+	router := chi.NewRouter()
+	limit := library.NewRateLimiter(library.RateLimit{Rate: 1, Burst: 1})
+	oai.NewHandler(router, library.NewBookService(memory.NewMemoryBookStore()), oai.Repository{Name: "Test library"},
+		oai.WithRateLimit(limit)).Register()
+
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oai?verb=Identify", nil))
+		if rr.Code != want {
+			t.Errorf("request %d: want status %d, got %d", i, want, rr.Code)
+		}
+	}
+}
+
+// A book withdrawn from the public catalogue must reach harvesters as a deleted record
+func TestHandler_withdrawn(t *testing.T) {
+	ctx := context.Background()
+	bookService := library.NewBookService(memory.NewMemoryBookStore())
+	for _, book := range []library.Book{
+		{ID: "1", Title: "Go Programming", Author: "Alan Donovan"},
+		{ID: "2", Title: "Go Roadmap", Author: "Alan Donovan"},
+	} {
+		if _, err := bookService.CreateBook(ctx, book); err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := chi.NewRouter()
+	oai.NewHandler(router, bookService, oai.Repository{Identifier: "test"}).Register()
+
+	harvest := func() []record {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/oai?verb=ListRecords&metadataPrefix=oai_dc", nil))
+		var resp response
+		if err := xml.NewDecoder(rr.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.ListRecords.Records
+	}
+
+	if records := harvest(); len(records) != 2 || records[1].Header.Status != "" || records[1].Title != "Go Roadmap" {
+		t.Fatalf("want both books harvested, got %+v", records)
+	}
+
+	hidden := library.Book{Title: "Go Roadmap", Author: "Alan Donovan", Visibility: library.VisibilityHidden}
+	if err := bookService.UpdateBook(ctx, "2", hidden); err != nil {
+		t.Fatal(err)
+	}
+	records := harvest()
+	if len(records) != 2 || records[0].Header.Status != "" {
+		t.Fatalf("want the public book harvested as before, got %+v", records)
+	}
+	if records[1].Header.Identifier != "oai:test:2" || records[1].Header.Status != "deleted" || records[1].Title != "" {
+		t.Errorf("want the hidden book as a deleted record without metadata, got %+v", records[1])
+	}
+}
@@ -11,10 +11,35 @@ var ErrLoadBooks = errors.New("Could not load books")
 var ErrCreateBook = errors.New("Could not create book")
 var ErrUpdateBook = errors.New("Could not update book")
 var ErrDeleteBook = errors.New("Could not delete book")
+var ErrInvalidBook = errors.New("Invalid book")
+
+// Import errors
+var ErrUnknownFormat = errors.New("Unknown import format")
+var ErrUnknownMode = errors.New("Unknown import mode")
+var ErrImportHeader = errors.New("Invalid import header")
+var ErrUnmappedRecord = errors.New("Could not map MARC record onto book")
+
+// Audit errors
+var ErrAudit = errors.New("Could not record audit entry")
+var ErrAuditDisabled = errors.New("Audit log is disabled")
+
+// Auth errors
+var ErrMalformedAuthorization = errors.New("Malformed Authorization header")
+var ErrInvalidToken = errors.New("Invalid token")
+var ErrUserServiceUnavailable = errors.New("User service unavailable")
+var ErrJWTKeys = errors.New("Could not load JWT keys")
 
 // Real DB specific
 var ErrCreatingTable = errors.New("Could not create table")
 var ErrDBSetup = errors.New("Could not setup db")
+var ErrMigration = errors.New("Could not migrate db")
 
 // OS errors
 var ErrOSMkdir = errors.New("Could not execute MKDir")
+
+// Tracing errors
+var ErrTracing = errors.New("Could not set up tracing")
+
+// Server errors
+var ErrTLS = errors.New("Could not set up TLS")
+var ErrListen = errors.New("Could not listen")
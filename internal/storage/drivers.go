@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/sqlite"
+)
+
+func init() {
+	Register("memory", openMemory)
+	Register("sqlite", openSQLite)
+}
+
+func openSQLite(opts Options) (Backend, error) {
+	return sqlite.NewSQLiteBookStore(opts.DSN,
+		sqlite.WithWAL(opts.SQLite.WAL),
+		sqlite.WithBusyTimeout(opts.SQLite.BusyTimeout),
+		sqlite.WithMaxOpenConns(opts.SQLite.MaxOpenConns),
+	)
+}
+
+// Memory store kept in its snapshot file and write-ahead log, if any
+type memoryBackend struct {
+	*memory.MemoryBookStore
+}
+
+func openMemory(opts Options) (Backend, error) {
+	store, err := memory.OpenMemoryBookStore(memory.Persistence{
+		SnapshotFile: opts.Memory.SnapshotFile,
+		WAL:          opts.Memory.WAL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return memoryBackend{store}, nil
+}
+
+// The store works as long as the process does
+func (b memoryBackend) Check(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+)
+
+// Backend is an opened store of books and their audit log
+type Backend interface {
+	library.BookStore
+	library.AuditStore
+	library.BookCounter
+	// Check reports whether the store works, for readiness
+	Check(ctx context.Context) error
+	// Close releases the store, e.g. writes what is kept in memory out
+	Close() error
+}
+
+// Checkpointer is a backend keeping books in memory, Checkpoint writes them out
+type Checkpointer interface {
+	Checkpoint() error
+}
+
+// Options of the backends, every driver reads its own part
+type Options struct {
+	// DSN locates the database of drivers that have one
+	DSN    string
+	SQLite SQLiteOptions
+	Memory MemoryOptions
+}
+
+// SQLiteOptions tune the connections to the database
+type SQLiteOptions struct {
+	WAL          bool
+	BusyTimeout  time.Duration
+	MaxOpenConns int
+}
+
+// MemoryOptions make the memory store outlive the process, an empty SnapshotFile keeps nothing.
+// With WAL every change is logged next to the snapshot before it's applied.
+type MemoryOptions struct {
+	SnapshotFile string
+	WAL          bool
+}
+
+// Driver opens a backend
+type Driver func(opts Options) (Backend, error)
+
+var (
+	driversMu sync.RWMutex
+	drivers   = make(map[string]Driver)
+)
+
+// Register makes the driver available under the name. It panics if the name is taken,
+// like database/sql does, since that is a programming error.
+func Register(name string, driver Driver) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+
+	if _, ok := drivers[name]; ok {
+		panic("storage: driver " + name + " registered twice")
+	}
+	drivers[name] = driver
+}
+
+// Drivers lists the names of the registered drivers in order
+func Drivers() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open opens the backend of the named driver
+func Open(name string, opts Options) (Backend, error) {
+	driversMu.RLock()
+	driver, ok := drivers[name]
+	driversMu.RUnlock()
+	if !ok {
+		return nil, errors.Wrap(oops.ErrDBSetup, fmt.Sprintf("unknown driver %q, expected one of %s", name, strings.Join(Drivers(), ", ")))
+	}
+
+	backend, err := driver(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, oops.ErrDBSetup.Error())
+	}
+	return backend, nil
+}
@@ -0,0 +1,67 @@
+package storage_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/storage"
+)
+
+func TestOpen_memory(t *testing.T) {
+	ctx := context.Background()
+	opts := storage.Options{Memory: storage.MemoryOptions{SnapshotFile: filepath.Join(t.TempDir(), "books.json")}}
+
+	store, err := storage.Open("memory", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := library.NewBookService(store, library.WithAudit(store))
+	if _, err := service.CreateBook(ctx, library.Book{ID: "1", Title: "Go Programming"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next process starts where this one stopped
+	store, err = storage.Open("memory", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	book, err := store.LoadBookByID(ctx, "1")
+	if err != nil || book.Title != "Go Programming" {
+		t.Errorf("want book restored from the snapshot, got %+v, %v", book, err)
+	}
+	entries, err := store.LoadAudit(ctx, library.AuditFilter{})
+	if err != nil || len(entries) != 1 || entries[0].Hash == "" {
+		t.Errorf("want audit log restored from the snapshot, got %+v, %v", entries, err)
+	}
+}
+
+func TestOpen_sqlite(t *testing.T) {
+	store, err := storage.Open("sqlite", storage.Options{
+		DSN:    filepath.Join(t.TempDir(), "books.db"),
+		SQLite: storage.SQLiteOptions{WAL: true, MaxOpenConns: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	db := store.(interface{ DB() *sql.DB }).DB()
+	var mode string
+	if err := db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("want journal mode wal, got %q, %v", mode, err)
+	}
+	if got := db.Stats().MaxOpenConnections; got != 2 {
+		t.Errorf("want pool of 2 connections, got %d", got)
+	}
+
+	if _, err := storage.Open("postgres", storage.Options{}); err == nil || !strings.Contains(err.Error(), "memory, sqlite") {
+		t.Errorf("want unknown driver rejected with the known ones listed, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Fields holding trace and span IDs, which OTLP JSON encodes as hex rather than base64
+var idFields = map[string]bool{"traceId": true, "spanId": true, "parentSpanId": true}
+
+// otlpFile is an OTLP client writing every batch as a line of OTLP JSON,
+// the format read by the otlpjsonfile receiver of the OpenTelemetry Collector
+type otlpFile struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (f *otlpFile) Start(context.Context) error { return nil }
+
+func (f *otlpFile) Stop(context.Context) error { return nil }
+
+func (f *otlpFile) UploadTraces(_ context.Context, spans []*tracepb.ResourceSpans) error {
+	// The batch is an export request, marshalled here to avoid the collector service packages
+	request := struct {
+		ResourceSpans []any `json:"resourceSpans"`
+	}{ResourceSpans: make([]any, 0, len(spans))}
+	for _, resourceSpans := range spans {
+		data, err := protojson.MarshalOptions{UseEnumNumbers: true}.Marshal(resourceSpans)
+		if err != nil {
+			return errors.Wrap(err, oops.ErrTracing.Error())
+		}
+		doc, err := hexIDs(data)
+		if err != nil {
+			return errors.Wrap(err, oops.ErrTracing.Error())
+		}
+		request.ResourceSpans = append(request.ResourceSpans, doc)
+	}
+	line, err := json.Marshal(request)
+	if err != nil {
+		return errors.Wrap(err, oops.ErrTracing.Error())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err = f.w.Write(append(line, '\n'))
+	return err
+}
+
+// hexIDs decodes the protobuf JSON, re-encoding its IDs as OTLP JSON requires
+func hexIDs(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if err := walkIDs(doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func walkIDs(node any) error {
+	switch node := node.(type) {
+	case map[string]any:
+		for key, value := range node {
+			if id, ok := value.(string); ok && idFields[key] {
+				raw, err := base64.StdEncoding.DecodeString(id)
+				if err != nil {
+					return err
+				}
+				node[key] = hex.EncodeToString(raw)
+				continue
+			}
+			if err := walkIDs(value); err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, value := range node {
+			if err := walkIDs(value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
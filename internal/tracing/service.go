@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+// Service traces every call of the given book service
+func Service(next library.BookService) library.BookService {
+	return &bookService{next: next}
+}
+
+type bookService struct {
+	next library.BookService
+}
+
+func (s *bookService) GetBooks(ctx context.Context, filter library.BookFilter) (_ []library.Book, err error) {
+	ctx, span := start(ctx, "BookService.GetBooks")
+	defer func() { end(span, err) }()
+	return s.next.GetBooks(ctx, filter)
+}
+
+func (s *bookService) StreamBooks(ctx context.Context, filter library.BookFilter, fn func(library.Book) error) (err error) {
+	ctx, span := start(ctx, "BookService.StreamBooks")
+	defer func() { end(span, err) }()
+	return s.next.StreamBooks(ctx, filter, fn)
+}
+
+func (s *bookService) GetBookByID(ctx context.Context, id string) (_ *library.Book, err error) {
+	ctx, span := start(ctx, "BookService.GetBookByID", bookIDKey.String(id))
+	defer func() { end(span, err) }()
+	return s.next.GetBookByID(ctx, id)
+}
+
+func (s *bookService) GetBookByISBN(ctx context.Context, isbn string) (_ *library.Book, err error) {
+	ctx, span := start(ctx, "BookService.GetBookByISBN")
+	defer func() { end(span, err) }()
+	return s.next.GetBookByISBN(ctx, isbn)
+}
+
+func (s *bookService) CreateBook(ctx context.Context, book library.Book) (_ string, err error) {
+	ctx, span := start(ctx, "BookService.CreateBook", bookIDKey.String(book.ID))
+	defer func() { end(span, err) }()
+	return s.next.CreateBook(ctx, book)
+}
+
+func (s *bookService) UpdateBook(ctx context.Context, id string, book library.Book) (err error) {
+	ctx, span := start(ctx, "BookService.UpdateBook", bookIDKey.String(id))
+	defer func() { end(span, err) }()
+	return s.next.UpdateBook(ctx, id, book)
+}
+
+func (s *bookService) DeleteBook(ctx context.Context, id string) (err error) {
+	ctx, span := start(ctx, "BookService.DeleteBook", bookIDKey.String(id))
+	defer func() { end(span, err) }()
+	return s.next.DeleteBook(ctx, id)
+}
+
+func (s *bookService) GetAudit(ctx context.Context, filter library.AuditFilter) (_ []library.AuditEntry, err error) {
+	ctx, span := start(ctx, "BookService.GetAudit")
+	defer func() { end(span, err) }()
+	return s.next.GetAudit(ctx, filter)
+}
+
+func (s *bookService) VerifyAudit(ctx context.Context) (_ library.AuditVerification, err error) {
+	ctx, span := start(ctx, "BookService.VerifyAudit")
+	defer func() { end(span, err) }()
+	return s.next.VerifyAudit(ctx)
+}
@@ -0,0 +1,41 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/oops"
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attributes of the service's own spans
+var (
+	requestIDKey = attribute.Key("request.id")
+	bookIDKey    = attribute.Key("book.id")
+)
+
+// Start a span of an internal call
+func start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer().Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End the span, marking it failed unless the error is the caller's mistake
+func end(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		if !expected(err) {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// Errors caused by the request rather than by the service
+func expected(err error) bool {
+	return errors.Is(err, oops.ErrUnexistedBook) ||
+		errors.Is(err, oops.ErrDuplicateID) ||
+		errors.Is(err, oops.ErrInvalidBook) ||
+		errors.Is(err, oops.ErrInvalidToken)
+}
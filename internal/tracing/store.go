@@ -0,0 +1,89 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+)
+
+// Store traces every call of the given store
+func Store(next library.BookStore) library.BookStore {
+	return &bookStore{next: next}
+}
+
+type bookStore struct {
+	next library.BookStore
+}
+
+func (s *bookStore) LoadBooks(ctx context.Context, filter library.BookFilter) (_ []library.Book, err error) {
+	ctx, span := start(ctx, "BookStore.LoadBooks")
+	defer func() { end(span, err) }()
+	return s.next.LoadBooks(ctx, filter)
+}
+
+// The span lasts until the caller has consumed every book
+func (s *bookStore) IterateBooks(ctx context.Context, filter library.BookFilter, fn func(library.Book) error) (err error) {
+	ctx, span := start(ctx, "BookStore.IterateBooks")
+	defer func() { end(span, err) }()
+	return s.next.IterateBooks(ctx, filter, fn)
+}
+
+func (s *bookStore) LoadBookByID(ctx context.Context, id string, visibility ...library.Visibility) (_ *library.Book, err error) {
+	ctx, span := start(ctx, "BookStore.LoadBookByID", bookIDKey.String(id))
+	defer func() { end(span, err) }()
+	return s.next.LoadBookByID(ctx, id, visibility...)
+}
+
+func (s *bookStore) LoadBookByISBN(ctx context.Context, isbn string, visibility ...library.Visibility) (_ *library.Book, err error) {
+	ctx, span := start(ctx, "BookStore.LoadBookByISBN")
+	defer func() { end(span, err) }()
+	return s.next.LoadBookByISBN(ctx, isbn, visibility...)
+}
+
+func (s *bookStore) SaveBook(ctx context.Context, book library.Book) (_ string, err error) {
+	ctx, span := start(ctx, "BookStore.SaveBook", bookIDKey.String(book.ID))
+	defer func() { end(span, err) }()
+	return s.next.SaveBook(ctx, book)
+}
+
+func (s *bookStore) UpdateBook(ctx context.Context, id string, book library.Book) (err error) {
+	ctx, span := start(ctx, "BookStore.UpdateBook", bookIDKey.String(id))
+	defer func() { end(span, err) }()
+	return s.next.UpdateBook(ctx, id, book)
+}
+
+func (s *bookStore) DeleteBook(ctx context.Context, id string) (err error) {
+	ctx, span := start(ctx, "BookStore.DeleteBook", bookIDKey.String(id))
+	defer func() { end(span, err) }()
+	return s.next.DeleteBook(ctx, id)
+}
+
+// Audit traces every call of the given audit log, including the calls
+// a change makes to the books within its transaction
+func Audit(next library.AuditStore) library.AuditStore {
+	return &auditStore{next: next}
+}
+
+type auditStore struct {
+	next library.AuditStore
+}
+
+func (s *auditStore) AuditChange(ctx context.Context, change library.BookChange) (_ library.AuditEntry, err error) {
+	ctx, span := start(ctx, "AuditStore.AuditChange")
+	defer func() { end(span, err) }()
+	return s.next.AuditChange(ctx, func(ctx context.Context, books library.BookStore) (library.AuditEntry, error) {
+		return change(ctx, Store(books))
+	})
+}
+
+func (s *auditStore) LoadAudit(ctx context.Context, filter library.AuditFilter) (_ []library.AuditEntry, err error) {
+	ctx, span := start(ctx, "AuditStore.LoadAudit")
+	defer func() { end(span, err) }()
+	return s.next.LoadAudit(ctx, filter)
+}
+
+func (s *auditStore) IterateAudit(ctx context.Context, fn func(library.AuditEntry) error) (err error) {
+	ctx, span := start(ctx, "AuditStore.IterateAudit")
+	defer func() { end(span, err) }()
+	return s.next.IterateAudit(ctx, fn)
+}
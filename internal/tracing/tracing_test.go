@@ -0,0 +1,136 @@
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library/memory"
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// Trace started by the caller of the service
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+)
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var propagated string
+	userServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		propagated = r.Header.Get("traceparent")
+		w.Write([]byte(`{"user_id": "42", "permissios": "1"}`))
+	}))
+	t.Cleanup(userServer.Close)
+	users := tracing.Users(library.NewUserServiceClient(strings.TrimPrefix(userServer.URL, "http://")))
+
+	router := chi.NewRouter()
+	router.Use(tracing.Middleware)
+	service := tracing.Service(library.NewBookService(tracing.Store(memory.NewMemoryBookStore())))
+	library.NewHandler(router, service, users).Register()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/books/new", strings.NewReader(`{"id": "1", "title": "Go Programming"}`))
+	req.Header.Set("Authorization", "Bearer token")
+	req.Header.Set("traceparent", traceparent)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("want status %d, got %d", http.StatusCreated, rr.Code)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+		if span.SpanContext.TraceID().String() != traceID {
+			t.Errorf("span %s is not part of the caller's trace", span.Name)
+		}
+	}
+
+	// Every layer has its span, nested in the order of calls
+	parents := map[string]string{
+		"POST /api/v1/books/new":   "",
+		"UserService.Authenticate": "POST /api/v1/books/new",
+		"POST /user/permissions":   "UserService.Authenticate",
+		"BookService.CreateBook":   "POST /api/v1/books/new",
+		"BookStore.SaveBook":       "BookService.CreateBook",
+	}
+	for name, parent := range parents {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no span %s", name)
+			continue
+		}
+		if parent != "" && span.Parent.SpanID() != spans[parent].SpanContext.SpanID() {
+			t.Errorf("span %s is not a child of %s", name, parent)
+		}
+	}
+
+	client := spans["POST /user/permissions"].SpanContext
+	if !strings.Contains(propagated, client.TraceID().String()+"-"+client.SpanID().String()) {
+		t.Errorf("want trace context of the client span sent to the user service, got %q", propagated)
+	}
+}
+
+func TestSetup_file(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	stop, err := tracing.Setup(tracing.Options{ServiceName: "book-service", Exporter: tracing.ExporterFile, File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "offline", trace.WithSpanKind(trace.SpanKindServer))
+	span.End()
+	if err := stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A line of OTLP JSON, with hex IDs and numeric enums
+	var line struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID string `json:"traceId"`
+					SpanID  string `json:"spanId"`
+					Name    string `json:"name"`
+					Kind    int    `json:"kind"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	if err := json.Unmarshal(data, &line); err != nil || !strings.HasSuffix(string(data), "\n") {
+		t.Fatalf("want a line of JSON, got %s (%v)", data, err)
+	}
+	if len(line.ResourceSpans) != 1 || len(line.ResourceSpans[0].ScopeSpans) != 1 || len(line.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("want one span, got %s", data)
+	}
+	got := line.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	want := span.SpanContext()
+	if got.Name != "offline" || got.TraceID != want.TraceID().String() || got.SpanID != want.SpanID().String() || got.Kind != int(tracepb.Span_SPAN_KIND_SERVER) {
+		t.Errorf("span not exported as OTLP JSON: %s", data)
+	}
+
+	if _, err := tracing.Setup(tracing.Options{Exporter: "zipkin"}); err == nil {
+		t.Error("want unknown exporter rejected")
+	}
+}
@@ -0,0 +1,29 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/mipt-kp-2024-go-beer/book-service/internal/library"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Users traces token lookups of the given user service, the attempts of
+// UserServiceClient show up as client spans below
+func Users(next library.UserService) library.UserService {
+	return &userService{next: next}
+}
+
+type userService struct {
+	next library.UserService
+}
+
+func (u *userService) Authenticate(ctx context.Context, token string) (_ *library.Principal, err error) {
+	ctx, span := start(ctx, "UserService.Authenticate")
+	defer func() { end(span, err) }()
+
+	principal, err := u.next.Authenticate(ctx, token)
+	if principal != nil {
+		span.SetAttributes(attribute.String("user.id", principal.UserID))
+	}
+	return principal, err
+}
@@ -2,33 +2,78 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
 
 	"github.com/mipt-kp-2024-go-beer/book-service/internal/app"
 )
 
 func main() {
-	config, err := app.NewConfig("configs/config.yml")
+	// Without a command the service is started
+	command := "serve"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "serve":
+		err = serve(args)
+	case "import":
+		err = importBooks(args)
+	case "fake-users":
+		err = fakeUsers(args)
+	default:
+		err = fmt.Errorf("unknown command %q, expected one of: serve, import, fake-users", command)
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
 	if err != nil {
-		log.Fatalf("Failed to open config: %s", err)
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// Run the HTTP server, settings of the configuration file can be overridden by flags
+func serve(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	loader := app.NewConfigLoader(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := loader.Load()
+	if err != nil {
+		return fmt.Errorf("Failed to load config: %s", err)
 	}
 
 	// Create a new app instance
 	ctx := context.Background()
 	appInstance, err := app.New(ctx, config)
 	if err != nil {
-		log.Fatalf("Failed to initialize app: %v", err)
+		return fmt.Errorf("Failed to initialize app: %v", err)
 	}
 
 	// Setup the application (initialize DB, services, and routes)
 	if err := appInstance.Setup(ctx); err != nil {
-		log.Fatalf("Failed to setup app: %v", err)
+		appInstance.Close()
+		return fmt.Errorf("Failed to setup app: %v", err)
 	}
 
-	// Run the app (start the HTTP server)
+	// Reload the configuration file on changes and SIGHUP
+	appInstance.WatchConfig(loader)
+
+	// Run the app (start the HTTP server) until SIGINT or SIGTERM
 	if err := appInstance.Start(); err != nil {
-		log.Fatalf("Failed to start app: %v", err)
+		return fmt.Errorf("Failed to start app: %v", err)
 	}
 
-	log.Println("Application has started successfully")
+	slog.Info("Application has stopped")
+	return nil
 }